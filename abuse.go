@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// kinds of miner behaviour that are counted by the abuse detector
+const (
+	abuseClaim         = "claim"
+	abuseCancel        = "cancel"
+	abuseExpiry        = "expiry"
+	abuseInvalidUpload = "invalidupload"
+	abuseCheck         = "check"
+)
+
+// abuseRule : how many events of one kind a miner may cause inside a rolling window
+type abuseRule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// a normal miner claims one job, /checks every few offsets and uploads once,
+// so these only trip when a script is stuck in a loop
+var abuseRules = map[string]abuseRule{
+	abuseClaim:         {Limit: 15, Window: 10 * time.Minute},
+	abuseCancel:        {Limit: 10, Window: 10 * time.Minute},
+	abuseExpiry:        {Limit: 3, Window: 6 * time.Hour},
+	abuseInvalidUpload: {Limit: 3, Window: time.Hour},
+	abuseCheck:         {Limit: 60, Window: time.Minute},
+}
+
+// abuseStep : what happens to a miner on their nth strike
+type abuseStep struct {
+	Action   string
+	Duration time.Duration
+}
+
+// a miner with no new strike for this long starts again at the bottom of the ladder
+var strikeDecay = envDuration("SEEDHELPER_STRIKE_DECAY", 30*24*time.Hour)
+
+// escalation ladder, the last step is repeated for any further strikes
+var abuseSteps = []abuseStep{
+	{Action: "throttle", Duration: 10 * time.Minute},
+	{Action: "throttle", Duration: time.Hour},
+	{Action: "suspend", Duration: 24 * time.Hour},
+	{Action: "suspend", Duration: 7 * 24 * time.Hour},
+	{Action: "ban"},
+}
+
+// how many entries a miner's abuse log keeps, the oldest are dropped first
+const abuseLogSize = 50
+
+// AbuseEvent : entry in a miner's abuse log
+type AbuseEvent struct {
+	Time   time.Time
+	Kind   string
+	Count  int
+	Action string
+	Until  time.Time `bson:",omitempty"`
+}
+
+// abuseTracker : rolling per miner event counters
+type abuseTracker struct {
+	sync.Mutex
+	events    map[string]map[string][]time.Time
+	throttled map[string]time.Time
+}
+
+var abuse = &abuseTracker{
+	events:    map[string]map[string][]time.Time{},
+	throttled: map[string]time.Time{},
+}
+
+// record counts an event for a miner and escalates if the rule for that kind is exceeded
+func (t *abuseTracker) record(ip string, kind string) {
+	rule, ok := abuseRules[kind]
+	if ok == false || ip == "" {
+		return
+	}
+	now := time.Now()
+	t.Lock()
+	if t.events[ip] == nil {
+		t.events[ip] = map[string][]time.Time{}
+	}
+	times := prune(append(t.events[ip][kind], now), now.Add(-rule.Window))
+	count := len(times)
+	tripped := count > rule.Limit
+	if tripped {
+		// start counting afresh so one burst is one strike
+		times = nil
+	}
+	t.events[ip][kind] = times
+	t.Unlock()
+
+	if tripped {
+		t.escalate(ip, kind, count)
+	}
+}
+
+// escalate applies the next step on the ladder and logs it in the miner's record
+func (t *abuseTracker) escalate(ip string, kind string, count int) {
+	var miner Miner
+	err := minerCollection.Find(bson.M{"_id": ip}).One(&miner)
+	if err != nil && err != mgo.ErrNotFound {
+		baseLog.Error("finding miner", "miner", ip, "err", err)
+		return
+	}
+	strikes := miner.Strikes
+	if miner.StrikesExpire.Before(time.Now()) {
+		strikes = 0
+	}
+	step := abuseSteps[len(abuseSteps)-1]
+	if strikes < len(abuseSteps) {
+		step = abuseSteps[strikes]
+	}
+	event := AbuseEvent{Time: time.Now(), Kind: kind, Count: count, Action: step.Action}
+	set := bson.M{"strikes": strikes + 1, "strikesexpire": event.Time.Add(strikeDecay)}
+	switch step.Action {
+	case "throttle":
+		event.Until = event.Time.Add(step.Duration)
+		// kept on the miner too so a restart doesn't lift it
+		set["throttleduntil"] = event.Until
+		t.Lock()
+		t.throttled[ip] = event.Until
+		t.Unlock()
+	case "suspend":
+		event.Until = event.Time.Add(step.Duration)
+		set["suspendeduntil"] = event.Until
+	case "ban":
+		set["banned"] = true
+	}
+	update := bson.M{"$set": set, "$push": bson.M{"abuselog": bson.M{"$each": []AbuseEvent{event}, "$slice": -abuseLogSize}}}
+	_, err = minerCollection.Upsert(bson.M{"_id": ip}, update)
+	if err != nil {
+		baseLog.Error("saving abuse event", "miner", ip, "err", err)
+	}
+	baseLog.Warn("abuse detected", "miner", ip, "kind", kind, "count", count, "action", step.Action, "until", event.Until)
+}
+
+// loadThrottles picks up the throttles that were running when the server last stopped
+func (t *abuseTracker) loadThrottles() {
+	var throttled []Miner
+	err := minerCollection.Find(bson.M{"throttleduntil": bson.M{"$gt": time.Now()}}).Select(bson.M{"throttleduntil": 1}).All(&throttled)
+	if err != nil {
+		baseLog.Error("loading throttles", "err", err)
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, miner := range throttled {
+		t.throttled[miner.IP] = miner.ThrottledUntil
+	}
+}
+
+// isThrottled reports whether a miner should be refused work for now
+func (t *abuseTracker) isThrottled(ip string) bool {
+	t.Lock()
+	defer t.Unlock()
+	until, ok := t.throttled[ip]
+	if ok && until.Before(time.Now()) {
+		delete(t.throttled, ip)
+		return false
+	}
+	return ok
+}
+
+// cleanup drops counters that have fallen out of every window, called from the anti abuse task
+func (t *abuseTracker) cleanup() {
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	for ip, kinds := range t.events {
+		for kind, times := range kinds {
+			times = prune(times, now.Add(-abuseRules[kind].Window))
+			if len(times) == 0 {
+				delete(kinds, kind)
+			} else {
+				kinds[kind] = times
+			}
+		}
+		if len(kinds) == 0 {
+			delete(t.events, ip)
+		}
+	}
+	for ip, until := range t.throttled {
+		if until.Before(now) {
+			delete(t.throttled, ip)
+		}
+	}
+}
+
+// prune removes times before the cutoff, times are in order
+func prune(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
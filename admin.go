@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+// token that unlocks the /admin endpoints, they are disabled if it isn't set
+var adminToken = os.Getenv("SEEDHELPER_ADMIN_TOKEN")
+
+// isAdmin checks the X-Seedhelper-Admin header against the admin token
+func isAdmin(r *http.Request) bool {
+	token := r.Header.Get("X-Seedhelper-Admin")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminOnly wraps an admin handler so anyone else gets a 403
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAdmin(r) == false {
+			w.WriteHeader(403)
+			w.Write([]byte("forbidden"))
+			return
+		}
+		handler(w, r)
+	}
+}
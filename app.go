@@ -2,21 +2,20 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/CloudyKit/jet"
@@ -33,35 +32,67 @@ var mgoSession mgo.Session
 var devices *mgo.Collection
 var minerCollection *mgo.Collection
 var lastBotInteraction time.Time
-var miners map[string]time.Time
-var iminers map[string]time.Time
+
+// miners were seen in the last 5 minutes, iminers asked for work in the last 30 seconds. Handlers
+// write them and the anti abuse task prunes them, so they are only touched under minersLock.
+var miners = map[string]time.Time{}
+var iminers = map[string]time.Time{}
+var minersLock sync.Mutex
 var ipPriority []string
 var botIP string
-var connections map[string]*websocket.Conn
 
 // Device : struct for devices
 type Device struct {
-	FriendCode uint64
-	ID0        string `bson:"_id"`
-	HasMovable bool
-	HasPart1   bool
-	HasAdded   bool
-	WantsBF    bool
-	LFCS       [8]byte
-	MSed       [0x140]byte
-	MSData     [12]byte
-	ExpiryTime time.Time `bson:",omitempty"`
-	CheckTime  time.Time
-	Miner      string
-	Expired    bool
-	Cancelled  bool
+	FriendCode  uint64
+	ID0         string `bson:"_id"`
+	HasMovable  bool
+	HasPart1    bool
+	HasAdded    bool
+	WantsBF     bool
+	LFCS        [8]byte
+	MSed        [0x140]byte
+	MSData      [12]byte
+	ExpiryTime  time.Time `bson:",omitempty"`
+	CheckTime   time.Time
+	Miner       string
+	Expired     bool
+	Cancelled   bool
+	Submitter   string
+	SubmittedAt time.Time
+	ClaimedAt   time.Time
+	Failures    int
+	// hashes of the submitter's session token and recovery code
+	TokenHash    string
+	RecoveryHash string
+	CompletedAt  time.Time
+	MSedPurged   bool
+	Downloads    int
+	// LFCS and MSed when they are encrypted, see crypt.go
+	LFCSSealed *Sealed `bson:",omitempty"`
+	MSedSealed *Sealed `bson:",omitempty"`
+	// searched in ranges by several miners, see ranges.go
+	Split bool
+	// how far from the msed3 estimate the current miner has got, and previous attempts got, see retry.go
+	Progress   int
+	SearchedTo int
+	Retries    int
+	Attempts   []JobAttempt
+	FlagReason string
 }
 
 // Miner : struct for tracking miners
 type Miner struct {
-	IP     string `bson:"_id"`
-	Score  int
-	Banned bool
+	IP             string `bson:"_id"`
+	Name           string `bson:",omitempty"`
+	Score          int
+	Banned         bool
+	Strikes        int
+	StrikesExpire  time.Time // strikes older than this are forgotten
+	ThrottledUntil time.Time
+	SuspendedUntil time.Time
+	AbuseLog       []AbuseEvent
+	MinerStats     `bson:",inline"`
+	Capabilities   Capabilities
 }
 
 func contains(s []string, e string) bool {
@@ -73,110 +104,160 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func buildMessage(command string) []byte {
-	message := make(map[string]interface{})
-	message["status"] = command
-	message["minerCount"] = len(miners)
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		baseLog.Error("encoding json", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// siteStats counts the devices in each stage for the status bar
+func siteStats() (map[string]int, error) {
+	stats := map[string]int{}
 	c, err := devices.Find(bson.M{"haspart1": true, "wantsbf": true, "expirytime": time.Time{}, "expired": bson.M{"$ne": true}}).Count()
 	if err != nil {
-		panic(err)
+		return nil, storeError(err)
 	}
-	message["userCount"] = c
+	stats["userCount"] = c
 	b, err := devices.Find(bson.M{"hasmovable": bson.M{"$ne": true}, "haspart1": true, "wantsbf": true, "expirytime": bson.M{"$gt": time.Now()}, "expired": bson.M{"$ne": true}}).Count()
 	if err != nil {
-		panic(err)
+		return nil, storeError(err)
 	}
-	message["miningCount"] = b
+	stats["miningCount"] = b
 	a, err := devices.Find(bson.M{"haspart1": true}).Count()
 	if err != nil {
-		panic(err)
+		return nil, storeError(err)
 	}
-	message["p1Count"] = a
+	stats["p1Count"] = a
 	z, err := devices.Find(bson.M{"hasmovable": true}).Count()
 	if err != nil {
-		panic(err)
+		return nil, storeError(err)
 	}
-	message["msCount"] = z
+	stats["msCount"] = z
 	n, err := devices.Count()
 	if err != nil {
-		panic(err)
-	}
-	message["totalCount"] = n
-	data, err := json.Marshal(message)
-	if err != nil {
-		return []byte("{}")
+		return nil, storeError(err)
 	}
-	return data
+	stats["totalCount"] = n
+	return stats, nil
 }
 
-func renderTemplate(template string, vars jet.VarMap, request *http.Request, writer http.ResponseWriter, context interface{}) {
-	writer.Header().Add("Link", "</static/js/script.js>; rel=preload; as=script, <https://fonts.gstatic.com>; rel=preconnect, <https://fonts.googleapis.com>; rel=preconnect, <https://bootswatch.com>; rel=preconnect, <https://cdn.jsdelivr.net>; rel=preconnect,")
-	t, err := view.GetTemplate(template)
-	if err != nil {
-		panic(err)
+func buildMessage(command string) []byte {
+	return encodeMessage(statusMessage(command))
+}
+
+// statusMessage is a status frame with the current stats
+// sawMiner records a request from a miner, idle if it was asking for work
+func sawMiner(ip string, idle bool) {
+	minersLock.Lock()
+	defer minersLock.Unlock()
+	miners[ip] = time.Now()
+	if idle {
+		iminers[ip] = time.Now()
 	}
-	vars.Set("isUp", (lastBotInteraction.After(time.Now().Add(time.Minute * -5))))
-	vars.Set("minerCount", len(miners))
-	c, err := devices.Find(bson.M{"haspart1": true, "wantsbf": true, "expirytime": time.Time{}, "expired": bson.M{"$ne": true}}).Count()
-	if err != nil {
-		panic(err)
+}
+
+// pruneMiners forgets miners that haven't been seen lately, called from the anti abuse task
+func pruneMiners() {
+	minersLock.Lock()
+	defer minersLock.Unlock()
+	for ip, miner := range miners {
+		if miner.Before(time.Now().Add(time.Minute * -5)) {
+			delete(miners, ip)
+		}
 	}
-	vars.Set("userCount", c)
-	b, err := devices.Find(bson.M{"hasmovable": bson.M{"$ne": true}, "haspart1": true, "wantsbf": true, "expirytime": bson.M{"$gt": time.Now()}, "expired": bson.M{"$ne": true}}).Count()
-	if err != nil {
-		panic(err)
+	for ip, miner := range iminers {
+		if miner.Before(time.Now().Add(time.Second * -30)) {
+			delete(iminers, ip)
+		}
 	}
-	vars.Set("miningCount", b)
-	a, err := devices.Find(bson.M{"haspart1": true}).Count()
-	if err != nil {
-		panic(err)
+}
+
+func minerCount() int {
+	minersLock.Lock()
+	defer minersLock.Unlock()
+	return len(miners)
+}
+
+func idleMinerCount() int {
+	minersLock.Lock()
+	defer minersLock.Unlock()
+	return len(iminers)
+}
+
+// activeMiners is every miner seen in the last 5 minutes
+func activeMiners() []string {
+	minersLock.Lock()
+	defer minersLock.Unlock()
+	ips := make([]string, 0, len(miners))
+	for ip := range miners {
+		ips = append(ips, ip)
 	}
-	vars.Set("p1Count", a)
-	z, err := devices.Find(bson.M{"hasmovable": true}).Count()
+	return ips
+}
+
+func statusMessage(command string) ServerMessage {
+	stats, err := siteStats()
 	if err != nil {
-		panic(err)
+		// the status is what matters, the stats can be left at zero
+		baseLog.Error("counting stats", "err", err)
 	}
-	vars.Set("msCount", z)
-	n, err := devices.Count()
+	return ServerMessage{Type: msgStatus, Status: command, SiteStats: &SiteStats{
+		MinerCount:  minerCount(),
+		UserCount:   stats["userCount"],
+		MiningCount: stats["miningCount"],
+		P1Count:     stats["p1Count"],
+		MSCount:     stats["msCount"],
+		TotalCount:  stats["totalCount"],
+	}}
+}
+
+func renderTemplate(template string, vars jet.VarMap, request *http.Request, writer http.ResponseWriter, context interface{}) error {
+	writer.Header().Add("Link", "</static/js/script.js>; rel=preload; as=script, <https://fonts.gstatic.com>; rel=preconnect, <https://fonts.googleapis.com>; rel=preconnect, <https://bootswatch.com>; rel=preconnect, <https://cdn.jsdelivr.net>; rel=preconnect,")
+	t, err := view.GetTemplate(template)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	vars.Set("totalCount", n)
-	var tminers []bson.M
-	q := minerCollection.Find(bson.M{"score": bson.M{"$gt": 0}}).Sort("-score").Limit(5)
-	err = q.All(&tminers)
+	vars.Set("isUp", botIsUp())
+	vars.Set("minerCount", minerCount())
+	stats, err := siteStats()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	vars.Set("miners", tminers)
-	//log.Println(miners, len(miners))
-	if err = t.Execute(writer, vars, nil); err != nil {
-		// error when executing template
-		panic(err)
+	for k, v := range stats {
+		vars.Set(k, v)
 	}
+	top, err := cachedLeaderboard("all", 1)
 	if err != nil {
-		panic(err)
+		return storeError(err)
 	}
-}
-
-func logger(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Do stuff here
-		log.Println(r.URL, r.Method, realip.FromRequest(r))
-		// Call the next handler, which can be another middleware in the chain, or the final handler.
-		next.ServeHTTP(w, r)
-	})
+	if len(top) > 5 {
+		top = top[:5]
+	}
+	vars.Set("miners", top)
+	//log.Println(miners, len(miners))
+	return t.Execute(writer, vars, nil)
 }
 
 func blacklist(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, _ := minerCollection.Find(bson.M{"_id": realip.FromRequest(r), "banned": true}).Count()
-		if c < 1 {
-			next.ServeHTTP(w, r)
-		} else {
-			w.WriteHeader(403)
+		s, _ := minerCollection.Find(bson.M{"_id": realip.FromRequest(r), "suspendeduntil": bson.M{"$gt": time.Now()}}).Count()
+		if c > 0 {
 			w.Header().Add("X-Seedhelper-Banned", "true")
+			w.WriteHeader(403)
 			w.Write([]byte("You have been banned from Seedhelper. This is probably because your script is glitching out. If you think you should be unbanned then find figgyc on Discord."))
+		} else if s > 0 {
+			w.Header().Add("X-Seedhelper-Suspended", "true")
+			w.WriteHeader(403)
+			w.Write([]byte("You have been temporarily suspended from Seedhelper because your script is glitching out. Check your setup and try again later."))
+		} else {
+			next.ServeHTTP(w, r)
 		}
 	})
 }
@@ -232,7 +313,7 @@ func checkIfID1(id1s string) bool {
 	*/
 	//id1s := "24A90106478089A4534C303800035344"
 	id1, err := hex.DecodeString(id1s)
-	if err != nil {
+	if err != nil || len(id1) != 16 {
 		return true
 	}
 	var chunks [8][2]byte
@@ -289,14 +370,139 @@ func checkIfID1(id1s string) bool {
 	return cid[15] == byte(0x00) && (cid[1] == byte(0x00) || cid[1] == byte(0x01))
 }
 
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// /socket: the websocket, see protocol.go
+func serveSocket(w http.ResponseWriter, r *http.Request) {
+	l := logFrom(r.Context()).With("session", newRequestID())
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.Warn("websocket upgrade failed", "err", err)
+		return
+	}
+	client := newSocketClient(conn)
+	go client.writeLoop()
+	atomic.AddInt64(&openSockets, 1)
+	defer func() {
+		atomic.AddInt64(&openSockets, -1)
+		removeConnection(client.watcher)
+		client.close()
+	}()
+	//... Use conn to send and receive messages.
+	session := &socketSession{submitted: map[string]bool{}}
+	for {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			l.Debug("websocket closed", "err", err)
+			return
+		}
+		if ok, _ := socketLimiter.allow(realip.FromRequest(r)); ok == false {
+			client.push(buildMessage("rateLimited"))
+			continue
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		reply, err := handleSocketMessage(l, client, realip.FromRequest(r), p, session)
+		if err != nil {
+			l.Warn("websocket message rejected", "err", err)
+			reply = errorMessage(err)
+		}
+		if reply != nil && client.push(reply) == false {
+			l.Warn("websocket too slow, dropped")
+			return
+		}
+	}
+}
+
+// /upload/id0: a miner's movable.sed, with its msed_data if it sent one
+func serveUpload(w http.ResponseWriter, r *http.Request) {
+	id0 := mux.Vars(r)["id0"]
+	l := logFrom(r.Context()).With("id0", id0)
+	movable, err := readMovable(r)
+	if err != nil {
+		abuse.record(realip.FromRequest(r), abuseInvalidUpload)
+		l.Warn("bad movable", "err", err)
+		writeMinerError(w, r, err)
+		return
+	}
+
+	// verify
+	keyy := movable[0x110:0x11F]
+	sha := sha256.Sum256(keyy)
+	testid0 := fmt.Sprintf("%08x%08x%08x%08x", sha[0:4], sha[4:8], sha[8:12], sha[12:16])
+	l.Debug("id0 check", "matches", testid0 == id0)
+
+	var solveTime time.Duration
+	var device Device
+	if err = devices.Find(bson.M{"_id": id0}).One(&device); err == nil && device.Miner == realip.FromRequest(r) && (device.ClaimedAt != time.Time{}) {
+		solveTime = time.Since(device.ClaimedAt)
+	} else if err == nil && device.Split {
+		solveTime = rangeSolveTime(id0, realip.FromRequest(r))
+	}
+
+	set, unset := bson.M{"hasmovable": true, "expirytime": time.Time{}, "wantsbf": false, "completedat": time.Now(), "msedpurged": false}, bson.M{}
+	if err := setSecret(set, unset, id0, "msed", movable[:]); err != nil {
+		writeMinerError(w, r, err)
+		return
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	err = devices.Update(bson.M{"_id": id0}, update)
+	if err == mgo.ErrNotFound {
+		writeMinerError(w, r, notFound("no such job"))
+		return
+	} else if err != nil {
+		writeMinerError(w, r, storeError(err))
+		return
+	}
+
+	if device.Split {
+		// the other miners on this job find out from /check
+		if err := clearRanges(id0); err != nil {
+			l.Error("clearing ranges", "err", err)
+		}
+	}
+	minerCollection.Upsert(bson.M{"_id": realip.FromRequest(r)}, bson.M{"$inc": bson.M{"score": 5}})
+	statsCompleted(realip.FromRequest(r), solveTime)
+	recordJobEvent(realip.FromRequest(r), "completed", 5, solveTime)
+	jobsMetric.inc("completed")
+	if solveTime > 0 {
+		solveTimeMetric.observe("", solveTime.Seconds())
+	}
+
+	notify(id0, "done")
+
+	w.Write([]byte("success"))
+
+	msed, err := readMsedData(r)
+	if err != nil {
+		l.Debug("no usable msed_data", "err", err)
+		return
+	}
+	record := newMsedRecord(id0, msed[:], realip.FromRequest(r), time.Now())
+	saved, err := saveMsedData(record)
+	if err != nil {
+		l.Error("saving msed_data", "err", err)
+		return
+	}
+	if saved {
+		learnMsed(record)
+	}
+	l.Debug("got msed_data", "new", saved)
+}
+
 func main() {
-	log.SetFlags(log.Lshortfile)
+	slog.SetDefault(baseLog)
 	lastBotInteraction = time.Now()
-	miners = map[string]time.Time{}
-	iminers = map[string]time.Time{}
 	ipPriority = strings.Split(os.Getenv("SEEDHELPER_IP_PRIORITY"), ",")
 	botIP = os.Getenv("SEEDHELPER_BOT_IP")
-	log.Println(ipPriority)
+	baseLog.Info("config", "ip_priority", ipPriority, "bot_ip", botIP)
 	// initialize mongo
 	mgoSession, err := mgo.Dial("localhost")
 	if err != nil {
@@ -306,6 +512,28 @@ func main() {
 
 	devices = mgoSession.DB("main").C("devices")
 	minerCollection = mgoSession.DB("main").C("miners")
+	jobEvents = mgoSession.DB("main").C("jobevents")
+	purgeLog = mgoSession.DB("main").C("purgelog")
+	msedData = mgoSession.DB("main").C("mseds")
+	counters = mgoSession.DB("main").C("counters")
+	msedModels = mgoSession.DB("main").C("models")
+	jobRanges = mgoSession.DB("main").C("ranges")
+	loadNameBlocklist()
+	ensureNameIndex()
+	backfillCompletedAt()
+	backfillRetentionTimes()
+	abuse.loadThrottles()
+	go rewrapSecrets()
+	ensureMsedIndex()
+	importLegacyMseds()
+	refreshMsedModel()
+	ensureRangeIndex()
+	if err = jobEvents.EnsureIndexKey("miner", "-time"); err != nil {
+		baseLog.Error("creating index", "err", err)
+	}
+	if err = jobEvents.EnsureIndexKey("time"); err != nil {
+		baseLog.Error("creating index", "err", err)
+	}
 
 	// init templates
 	view = jet.NewHTMLSet("./views")
@@ -317,271 +545,99 @@ func main() {
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	router.Use(logger)
+	router.Use(recoverer)
+	router.Use(instrument)
 	router.Use(filetypeFixer)
 	router.Use(blacklist)
+	router.Use(rateLimit)
 
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		renderTemplate("home", make(jet.VarMap), r, w, nil)
+		if err := renderTemplate("home", make(jet.VarMap), r, w, nil); err != nil {
+			writeError(w, r, err)
+		}
 	})
 
 	router.HandleFunc("/logo.png", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "logo.png")
 	})
 
-	// client:
-	connections = make(map[string]*websocket.Conn)
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
-
-	router.HandleFunc("/socket", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+	router.HandleFunc("/metrics", serveMetrics)
+	router.HandleFunc("/healthz", serveHealthz)
+	router.HandleFunc("/readyz", serveReadyz)
+	router.HandleFunc("/status", serveStatus)
+	router.HandleFunc("/status/{id0}", serveDeviceStatus)
+	router.HandleFunc("/events/{id0}", serveEvents)
+	router.HandleFunc("/mseds/v1", serveMseds)
+	router.HandleFunc("/mseds/v1/export", serveMsedExport)
+	router.HandleFunc("/mseds/v1/model", serveMsedModel)
+
+	router.HandleFunc("/leaderboard.json", func(w http.ResponseWriter, r *http.Request) {
+		window, page := leaderboardParams(r)
+		rows, err := cachedLeaderboard(window, page)
 		if err != nil {
-			log.Println(err)
+			w.WriteHeader(500)
+			logFrom(r.Context()).Error("computing leaderboard", "err", err)
 			return
 		}
-		//... Use conn to send and receive messages.
-		for {
-			messageType, p, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("disconnection?", err)
-				return
-			}
-			if messageType == websocket.TextMessage {
-				var object map[string]interface{}
-				err := json.Unmarshal(p, &object)
-				if err != nil {
-					log.Println(err)
-					//return
-					for k, v := range connections {
-						if v == conn {
-							delete(connections, k)
-						}
-					}
-					return
-				}
-				if object["id0"] == nil {
-					//return
-					continue
-				}
-				log.Println("identify:", realip.FromRequest(r), object["id0"])
-				//log.Println(object["part1"], "packet")
-				/*isRegistered := false
-				for _, v := range connections {
-					if v == conn {
-						isRegistered = true
-					}
-				}
-				if isRegistered == false {*/
-				connections[object["id0"].(string)] = conn
-				//}
-
-				if object["request"] == "bruteforce" {
-					// add to BF pool
-					err := devices.Update(bson.M{"_id": object["id0"].(string)}, bson.M{"$set": bson.M{"wantsbf": true, "expirytime": time.Time{}}})
-					if err != nil {
-						log.Println(err)
-						//return
-					}
-				} else if object["request"] == "cancel" {
-					// canseru jobbu
-					err := devices.Update(bson.M{"_id": object["id0"].(string)}, bson.M{"$set": bson.M{"cancelled": true}})
-					if err != nil {
-						w.Write([]byte("error"))
-						return
-					}
-				} else if object["part1"] != nil {
-					// add to work pool
-
-					c, err := devices.Find(bson.M{"_id": object["id0"], "expired": true}).Count()
-					if err != nil || c > 0 {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("flag")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					valid := true
-					if regexp.MustCompile("[0-9a-fA-F]{32}").MatchString(object["id0"].(string)) == false {
-						valid = false
-					}
-
-					if valid == false {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeInvalid")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					p1Slice, err := base64.StdEncoding.DecodeString(object["part1"].(string))
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					lfcsSlice := p1Slice[:8]
-					reverse(lfcsSlice)
-					var lfcsArray [8]byte
-					copy(lfcsArray[:], lfcsSlice[:])
-					var checkArray [8]byte
-					if lfcsArray == checkArray {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeInvalid")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					if object["defoID0"] != "yes" && checkIfID1(object["id0"].(string)) {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("couldBeID1")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					device := bson.M{"lfcs": lfcsArray, "haspart1": true, "hasadded": true, "wantsbf": true, "expirytime": time.Time{}}
-					_, err = devices.Upsert(bson.M{"_id": object["id0"].(string)}, device)
-					if err != nil {
-						log.Println(err)
-						//return
-					}
-					if err := conn.WriteMessage(websocket.TextMessage, buildMessage("queue")); err != nil {
-						log.Println(err)
-						//return
-					}
-				} else if object["friendCode"] != nil {
-					// add to bot pool
-
-					c, err := devices.Find(bson.M{"_id": object["id0"], "expired": true}).Count()
-					if err != nil || c > 0 {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("flag")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					/*
-						based on https://github.com/ihaveamac/Kurisu/blob/master/addons/friendcode.py#L24
-						    def verify_fc(self, fc):
-								fc = int(fc.replace('-', ''))
-								if fc > 0x7FFFFFFFFF:
-									return None
-								principal_id = fc & 0xFFFFFFFF
-								checksum = (fc & 0xFF00000000) >> 32
-								return (fc if hashlib.sha1(struct.pack('<L', principal_id)).digest()[0] >> 1 == checksum else None)
-					*/
-					valid := true
-					fc, err := strconv.Atoi(object["friendCode"].(string))
-					if err != nil {
-						valid = false
-					}
-					if fc > 0x7FFFFFFFFF {
-						valid = false
-					}
-					if fc == 27599290078 { // the bot
-						valid = false
-					}
-					principalID := fc & 0xFFFFFFFF
-					checksum := (fc & 0xFF00000000) >> 32
-
-					pidb := make([]byte, 4)
-					binary.LittleEndian.PutUint32(pidb, uint32(principalID))
-					if int(sha1.Sum(pidb)[0])>>1 != checksum {
-						valid = false
-					}
-
-					if regexp.MustCompile("[0-9a-fA-F]{32}").MatchString(object["id0"].(string)) == false {
-						valid = false
-					}
+		writeJSON(w, 200, bson.M{"window": window, "page": page, "pageSize": leaderboardPageSize, "miners": rows})
+	})
 
-					if valid == false {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeInvalid")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					if object["defoID0"] != "yes" && checkIfID1(object["id0"].(string)) == true {
-						if err := conn.WriteMessage(websocket.TextMessage, buildMessage("couldBeID1")); err != nil {
-							log.Println(err)
-							return
-						}
-						continue
-					}
-					log.Println(fc)
-					device := bson.M{"friendcode": uint64(fc), "hasadded": false, "haspart1": false}
-					_, err = devices.Upsert(bson.M{"_id": object["id0"].(string)}, device)
-					if err != nil {
-						log.Println(err)
-						//return
-					}
-					if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeProcessing")); err != nil {
-						log.Println(err)
-						//return
-					}
+	router.HandleFunc("/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		window, page := leaderboardParams(r)
+		rows, err := cachedLeaderboard(window, page)
+		if err != nil {
+			w.WriteHeader(500)
+			logFrom(r.Context()).Error("computing leaderboard", "err", err)
+			return
+		}
+		vars := make(jet.VarMap)
+		vars.Set("window", window)
+		vars.Set("page", page)
+		vars.Set("rows", rows)
+		vars.Set("prevPage", page-1)
+		vars.Set("nextPage", 0)
+		if len(rows) == leaderboardPageSize {
+			vars.Set("nextPage", page+1)
+		}
+		if err := renderTemplate("leaderboard", vars, r, w, nil); err != nil {
+			writeError(w, r, err)
+		}
+	})
 
-				} else {
-					// checc
-					//log.Println("check")
-					query := devices.Find(bson.M{"_id": object["id0"].(string)})
-					count, err := query.Count()
-					if err != nil {
-						log.Println(err)
-						//return
-					}
-					if count > 0 {
-						var device Device
-						err = query.One(&device)
-						if err != nil {
-							log.Println(err)
-							//return
-						}
-						if device.HasMovable == true {
-							if err := conn.WriteMessage(websocket.TextMessage, buildMessage("done")); err != nil {
-								log.Println(err)
-								//return
-							}
-						} else if (device.ExpiryTime != time.Time{}) {
-							if err := conn.WriteMessage(websocket.TextMessage, buildMessage("bruteforcing")); err != nil {
-								log.Println(err)
-								//return
-							}
-						} else if device.WantsBF == true {
-							if err := conn.WriteMessage(websocket.TextMessage, buildMessage("queue")); err != nil {
-								log.Println(err)
-								//return
-							}
-						} else if device.HasPart1 == true {
-							if err := conn.WriteMessage(websocket.TextMessage, buildMessage("movablePart1")); err != nil {
-								log.Println(err)
-								//return
-							}
-						} else if device.HasAdded == true {
-							if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeAdded")); err != nil {
-								log.Println(err)
-								//return
-							}
-						} else {
-							if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeProcessing")); err != nil {
-								log.Println(err)
-								//return
-							}
-						}
-					} else {
-						log.Println("empty id0 to socket, dropped DB?")
-						//return
-					}
-				}
-			} else if messageType == websocket.CloseMessage {
-				for k, v := range connections {
-					if v == conn {
-						delete(connections, k)
-					}
-				}
+	// /miner/{name}, as JSON with ?format=json or Accept: application/json. Names can end in anything,
+	// so the format isn't part of the path.
+	router.HandleFunc("/miner/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept")
+		page, err := minerPage(mux.Vars(r)["name"])
+		asJSON := r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+		if err == mgo.ErrNotFound && asJSON {
+			writeJSON(w, 404, bson.M{"error": "no miner with that name"})
+			return
+		} else if err == mgo.ErrNotFound {
+			w.WriteHeader(404)
+			if err := renderTemplate("404error", make(jet.VarMap), r, w, nil); err != nil {
+				logFrom(r.Context()).Error("rendering 404", "err", err)
 			}
-
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			logFrom(r.Context()).Error("loading miner page", "err", err)
+			return
+		}
+		if asJSON {
+			writeJSON(w, 200, page)
+			return
+		}
+		vars := make(jet.VarMap)
+		vars.Set("miner", page)
+		if err := renderTemplate("miner", vars, r, w, nil); err != nil {
+			writeError(w, r, err)
 		}
 	})
 
+	// client:
+	router.HandleFunc("/socket", serveSocket)
+
 	// part1 auto script:
 	// /getfcs
 	router.HandleFunc("/getfcs", func(w http.ResponseWriter, r *http.Request) {
@@ -615,11 +671,12 @@ func main() {
 			w.Write([]byte("fail"))
 			return
 		}
+		l := logFrom(r.Context()).With("fc", mux.Vars(r)["fc"])
 		b := mux.Vars(r)["fc"]
 		a, err := strconv.Atoi(b)
 		if err != nil {
 			w.Write([]byte("fail"))
-			log.Println(err)
+			l.Warn("bad friend code", "err", err)
 			return
 		}
 		fc := uint64(a)
@@ -629,7 +686,7 @@ func main() {
 		err = devices.Update(bson.M{"friendcode": fc, "hasadded": false}, bson.M{"$set": bson.M{"hasadded": true}})
 		if err != nil { // && err != mgo.ErrNotFound {
 			w.Write([]byte("fail"))
-			log.Println("a", err)
+			l.Error("marking friend code added", "err", err)
 			return
 		}
 
@@ -638,20 +695,10 @@ func main() {
 		err = query.One(&device)
 		if err != nil {
 			w.Write([]byte("fail"))
-			log.Println("x", err)
+			l.Error("finding device", "err", err)
 			return
 		}
-		for id0, conn := range connections {
-			//log.Println(id0, device.ID0, "hello!")
-			if id0 == device.ID0 {
-				if err := conn.WriteMessage(websocket.TextMessage, buildMessage("friendCodeAdded")); err != nil {
-					delete(connections, id0)
-					//w.Write([]byte("fail"))
-					log.Println(err)
-					//return
-				}
-			}
-		}
+		notify(device.ID0, "friendCodeAdded")
 		w.Write([]byte("success"))
 
 	})
@@ -663,18 +710,19 @@ func main() {
 			w.Write([]byte("fail"))
 			return
 		}
+		l := logFrom(r.Context()).With("fc", mux.Vars(r)["fc"])
 		b := mux.Vars(r)["fc"]
 		a, err := strconv.Atoi(b)
 		if err != nil {
 			w.Write([]byte("fail"))
-			log.Println(err)
+			l.Warn("bad friend code", "err", err)
 			return
 		}
 		fc := uint64(a)
 
 		lfcs, ok := r.URL.Query()["lfcs"]
 		if ok == false {
-			log.Println("wot")
+			l.Warn("no lfcs given")
 			w.Write([]byte("fail"))
 			return
 		}
@@ -682,7 +730,7 @@ func main() {
 		sliceLFCS, err := hex.DecodeString(lfcs[0])
 		if err != nil {
 			w.Write([]byte("fail"))
-			log.Println(err)
+			l.Warn("bad lfcs", "err", err)
 			return
 		}
 		var x [8]byte
@@ -690,105 +738,122 @@ func main() {
 		x[0] = 0x00
 		x[1] = 0x00
 		x[2] = 0x00
-		log.Println(fc, a, b, lfcs, x, sliceLFCS)
-		err = devices.Update(bson.M{"friendcode": fc, "haspart1": false}, bson.M{"$set": bson.M{"haspart1": true, "lfcs": x}})
-		if err != nil && err != mgo.ErrNotFound {
-			w.Write([]byte("fail"))
-			log.Println(err)
-			return
-		}
+		l.Info("got part1", "lfcs", hex.EncodeToString(x[:]))
 
-		query := devices.Find(bson.M{"friendcode": fc})
+		// the one still waiting for its part1 if there is one, the LFCS is sealed for its ID0
+		query := devices.Find(bson.M{"friendcode": fc}).Sort("haspart1")
 		var device Device
 		err = query.One(&device)
 		if err != nil {
-			log.Println(err)
+			l.Error("finding device", "err", err)
 			w.Write([]byte("fail"))
-			log.Println("las")
 			return
 		}
-		for id0, conn := range connections {
-			if id0 == device.ID0 {
-				if err := conn.WriteMessage(websocket.TextMessage, buildMessage("movablePart1")); err != nil {
-					log.Println(err)
-					delete(connections, id0)
-					//w.Write([]byte("fail"))
-					//return
-				}
-			}
+		set, unset := bson.M{"haspart1": true}, bson.M{}
+		if err := setSecret(set, unset, device.ID0, "lfcs", x[:]); err != nil {
+			w.Write([]byte("fail"))
+			l.Error("sealing lfcs", "err", err)
+			return
+		}
+		update := bson.M{"$set": set}
+		if len(unset) > 0 {
+			update["$unset"] = unset
 		}
+		err = devices.Update(bson.M{"_id": device.ID0, "haspart1": false}, update)
+		if err != nil && err != mgo.ErrNotFound {
+			w.Write([]byte("fail"))
+			l.Error("saving lfcs", "err", err)
+			return
+		}
+		notify(device.ID0, "movablePart1")
 
 		w.Write([]byte("success"))
-		log.Println("last")
 
 	})
 
 	// msed auto script:
 	// /cancel/id0
-	router.HandleFunc("/cancel/{id0}", func(w http.ResponseWriter, r *http.Request) {
-		id0 := mux.Vars(r)["id0"]
-		log.Println(id0)
-		kill := false
-
-		yn, ok := r.URL.Query()["kill"]
-		if ok == true {
-			if yn[0] == "n" {
-				kill = true
-			}
-		}
-
-		err := devices.Update(bson.M{"_id": id0}, bson.M{"$set": bson.M{"wantsbf": kill, "expired": (yn[0] == "y"), "expirytime": time.Time{}}})
-		if err != nil {
-			w.Write([]byte("error"))
-			return
-		}
-		w.Write([]byte("success"))
-
-		for id01, conn := range connections {
-			if id0 == id01 {
-				if err := conn.WriteMessage(websocket.TextMessage, buildMessage("flag")); err != nil {
-					log.Println(err)
-					delete(connections, id0)
-					return
-				}
-			}
-		}
-
-	})
+	router.HandleFunc("/cancel/{id0}", serveCancel)
+	// /release/id0 and /abandon/id0, see cancel.go
+	router.HandleFunc("/release/{id0}", serveRelease)
+	router.HandleFunc("/abandon/{id0}", serveAbandon)
 
 	// /setname
 	router.HandleFunc("/setname", func(w http.ResponseWriter, r *http.Request) {
-		names, ok := r.URL.Query()["name"]
-		name := names[0]
-		if ok == false || name == "" {
+		l := logFrom(r.Context())
+		name := r.URL.Query().Get("name")
+		if name == "" {
 			w.Write([]byte("specify a name"))
 			return
 		}
-		c, err := minerCollection.Find(bson.M{"_id": bson.M{"$ne": realip.FromRequest(r)}, "name": name}).Count()
+		name, err := normaliseName(name)
+		if err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+		key := nameKey(name)
+		c, err := minerCollection.Find(bson.M{"_id": bson.M{"$ne": realip.FromRequest(r)}, "namekey": key}).Count()
 		if err != nil || c != 0 {
 			w.Write([]byte("name taken"))
 			return
 		}
-		_, err = minerCollection.Upsert(bson.M{"_id": realip.FromRequest(r)}, bson.M{"$set": bson.M{"name": name}})
-		if err != nil {
+		_, err = minerCollection.Upsert(bson.M{"_id": realip.FromRequest(r)}, bson.M{"$set": bson.M{"name": name, "namekey": key}})
+		if mgo.IsDup(err) {
+			w.Write([]byte("name taken"))
+		} else if err != nil {
 			w.Write([]byte("error"))
 			w.Write([]byte(err.Error()))
-			log.Println(err)
+			l.Error("setting name", "err", err)
 		} else {
 			w.Write([]byte("success"))
 		}
 	})
 
+	// /admin/resetname?name=x
+	// clears a miner's name so it can't be seen or looked up, they can set a new one
+	router.HandleFunc("/admin/purges", adminOnly(servePurges))
+	router.HandleFunc("/admin/namecollisions", adminOnly(serveNameCollisions))
+	router.HandleFunc("/admin/resetname", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		l := logFrom(r.Context())
+		name := r.URL.Query().Get("name")
+		err := minerCollection.Update(bson.M{"namekey": nameKey(name)}, bson.M{"$unset": bson.M{"name": "", "namekey": ""}})
+		if err == mgo.ErrNotFound {
+			err = minerCollection.Update(bson.M{"name": name}, bson.M{"$unset": bson.M{"name": "", "namekey": ""}})
+		}
+		if err != nil {
+			w.Write([]byte("error"))
+			l.Error("resetting name", "err", err)
+			return
+		}
+		l.Info("admin reset name", "name", name)
+		w.Write([]byte("success"))
+	}))
+
 	// /getwork
 	router.HandleFunc("/getwork", func(w http.ResponseWriter, r *http.Request) {
-		miners[realip.FromRequest(r)] = time.Now()
-		iminers[realip.FromRequest(r)] = time.Now()
-		ok, err := devices.Find(bson.M{"miner": realip.FromRequest(r), "hasmovable": bson.M{"$ne": true}, "expirytime": bson.M{"$ne": time.Time{}}, "expired": bson.M{"$ne": true}}).Count()
-		if ok > 0 {
+		l := logFrom(r.Context())
+		sawMiner(realip.FromRequest(r), true)
+		caps, ok := negotiate(w, r)
+		if ok == false {
+			return
+		}
+		if abuse.isThrottled(realip.FromRequest(r)) {
+			w.Write([]byte("nothing"))
+			return
+		}
+		if rangeCount >= 2 && caps.maxJobTime() < time.Hour {
+			// too short for a whole job, /getrange has work it can finish
+			w.Write([]byte("nothing"))
+			return
+		}
+		if hashrate, err := strconv.ParseFloat(r.URL.Query().Get("hashrate"), 64); err == nil {
+			statsHashrate(realip.FromRequest(r), hashrate)
+		}
+		if minerBusy(realip.FromRequest(r)) {
 			w.Write([]byte("nothing"))
 			return
 		}
-		query := devices.Find(bson.M{"haspart1": true, "wantsbf": true, "expirytime": bson.M{"$eq": time.Time{}}, "expired": bson.M{"$ne": true}})
+		query := devices.Find(queuedWork(realip.FromRequest(r))).Sort("-failures")
 		count, err := query.Count()
 		if err != nil || count < 1 {
 			w.Write([]byte("nothing"))
@@ -798,84 +863,116 @@ func main() {
 		err = query.One(&aDevice)
 		if err != nil {
 			w.Write([]byte("nothing"))
-			log.Println(err)
+			l.Error("finding work", "err", err)
 			return
 		}
 		w.Write([]byte(aDevice.ID0))
 	})
+	// /getrange
+	router.HandleFunc("/getrange", serveGetRange)
 	// /claim/id0
 	router.HandleFunc("/claim/{id0}", func(w http.ResponseWriter, r *http.Request) {
-		ok, err := devices.Find(bson.M{"miner": realip.FromRequest(r), "hasmovable": bson.M{"$ne": true}, "expirytime": bson.M{"$ne": time.Time{}}}).Count()
-		if ok > 0 {
+		abuse.record(realip.FromRequest(r), abuseClaim)
+		if abuse.isThrottled(realip.FromRequest(r)) {
 			w.Write([]byte("nothing"))
 			return
 		}
+		if minerBusy(realip.FromRequest(r)) {
+			w.Write([]byte("nothing"))
+			return
+		}
+		caps, ok := negotiate(w, r)
+		if ok == false {
+			return
+		}
 		id0 := mux.Vars(r)["id0"]
-		//log.Println(id0)
-		err = devices.Update(bson.M{"_id": id0}, bson.M{"$set": bson.M{"expirytime": time.Now().Add(time.Hour), "miner": realip.FromRequest(r)}})
-		if err != nil {
-			log.Println(err)
+		var device Device
+		err := devices.Find(bson.M{"_id": id0}).One(&device)
+		if err == mgo.ErrNotFound {
+			writeMinerError(w, r, notFound("no such job or not one for this miner"))
+			return
+		} else if err != nil {
+			writeMinerError(w, r, storeError(err))
 			return
 		}
-		w.Write([]byte("success"))
-		miners[realip.FromRequest(r)] = time.Now()
-		for id02, conn := range connections {
-			//log.Println(id0, device.ID0, "hello!")
-			if id02 == id0 {
-				if err := conn.WriteMessage(websocket.TextMessage, buildMessage("bruteforcing")); err != nil {
-					delete(connections, id0)
-					//w.Write([]byte("fail"))
-					log.Println(err)
-					//return
-				}
-			}
+		// the same rules as /getwork, so a miner can't claim a job it wouldn't have been offered,
+		// and the retries it was given time for
+		work := queuedWork(realip.FromRequest(r))
+		work["_id"], work["split"] = id0, bson.M{"$ne": true}
+		work["retries"] = device.Retries
+		if device.Retries == 0 {
+			work["retries"] = bson.M{"$not": bson.M{"$gt": 0}}
+		}
+		err = devices.Update(work, bson.M{"$set": bson.M{"expirytime": time.Now().Add(attemptTime(caps, device.Retries)), "miner": realip.FromRequest(r), "claimedat": time.Now()}})
+		if err == mgo.ErrNotFound {
+			writeMinerError(w, r, notFound("no such job or not one for this miner"))
+			return
+		} else if err != nil {
+			writeMinerError(w, r, storeError(err))
+			return
 		}
+		statsClaimed(realip.FromRequest(r))
+		jobsMetric.inc("claimed")
+		w.Write([]byte("success"))
+		sawMiner(realip.FromRequest(r), false)
+		notify(id0, "bruteforcing")
 	})
 	// /part1/id0
 	// this is also used by client if they want self BF so /claim is needed
 	router.HandleFunc("/part1/{id0}", func(w http.ResponseWriter, r *http.Request) {
 		id0 := mux.Vars(r)["id0"]
-		query := devices.Find(bson.M{"_id": id0})
-		count, err := query.Count()
-		if err != nil || count < 1 {
-			w.Write([]byte("error"))
-			log.Println("z", err, count)
+		l := logFrom(r.Context()).With("id0", id0)
+		var device Device
+		err := devices.Find(bson.M{"_id": id0}).One(&device)
+		if err == mgo.ErrNotFound {
+			l.Debug("part1 for unknown device")
+			writeMinerError(w, r, notFound("no such device"))
+			return
+		} else if err != nil {
+			writeMinerError(w, r, storeError(err))
 			return
 		}
-		var device Device
-		err = query.One(&device)
-		if err != nil || device.HasPart1 == false {
-			w.Write([]byte("error"))
-			log.Println("a", err)
+		if device.HasPart1 == false {
+			writeMinerError(w, r, notFound("device has no part1"))
+			return
+		}
+		lfcs, err := deviceLFCS(device)
+		if err != nil {
+			writeMinerError(w, r, err)
 			return
 		}
 		buf := bytes.NewBuffer(make([]byte, 0, 0x1000))
 		leLFCS := make([]byte, 8)
-		binary.BigEndian.PutUint64(leLFCS, binary.LittleEndian.Uint64(device.LFCS[:]))
+		binary.BigEndian.PutUint64(leLFCS, binary.LittleEndian.Uint64(lfcs[:]))
 		_, err = buf.Write(leLFCS)
 		if err != nil {
 			w.Write([]byte("error"))
-			log.Println("b", err)
+			l.Error("building part1", "err", err)
 			return
 		}
 		_, err = buf.Write(make([]byte, 0x8))
 		if err != nil {
 			w.Write([]byte("error"))
-			log.Println("c", err)
+			l.Error("building part1", "err", err)
 			return
 		}
 		_, err = buf.Write([]byte(device.ID0))
 		if err != nil {
 			w.Write([]byte("error"))
-			log.Println("d", err)
+			l.Error("building part1", "err", err)
 			return
 		}
 		_, err = buf.Write(make([]byte, 0xFD0))
 		if err != nil {
 			w.Write([]byte("error"))
-			log.Println("e", err)
+			l.Error("building part1", "err", err)
 			return
 		}
+		setEstimateHeaders(w.Header(), leLFCS)
+		if device.SearchedTo > 0 {
+			// earlier attempts have already searched this close to the estimate
+			w.Header().Set("X-Seedhelper-Offset-Start", strconv.Itoa(device.SearchedTo))
+		}
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Header().Set("Content-Disposition", "inline; filename=\"movable_part1.sed\"")
 		w.Write(buf.Bytes())
@@ -884,193 +981,119 @@ func main() {
 	// allows user cancel and not overshooting the 1hr job max time
 	router.HandleFunc("/check/{id0}", func(w http.ResponseWriter, r *http.Request) {
 		id0 := mux.Vars(r)["id0"]
+		l := logFrom(r.Context()).With("id0", id0)
+		abuse.record(realip.FromRequest(r), abuseCheck)
 		query := devices.Find(bson.M{"_id": id0, "haspart1": true, "hasmovable": bson.M{"$ne": true}, "wantsbf": true, "miner": realip.FromRequest(r), "expirytime": bson.M{"$gt": time.Now()}})
 		count, err := query.Count()
-		if err != nil || count < 1 {
-			w.Write([]byte("error"))
-			log.Println("z", err, count)
-			return
+		answer := "ok"
+		if err == nil && count < 1 {
+			// split jobs are checked per range
+			jobRange, ok := checkRange(id0, realip.FromRequest(r), r.URL.Query().Get("range"), r.URL.Query().Get("offset"))
+			if ok {
+				count = 1
+			}
+			if ok && r.URL.Query().Get("range") == "" {
+				// the job was split while this miner had it whole, it keeps the first range
+				answer = fmt.Sprintf("range %d %d %d", jobRange.Index, jobRange.Start, jobRange.End)
+			}
 		}
-		devices.Update(bson.M{"_id": id0}, bson.M{"$set": bson.M{"checktime": time.Now().Add(time.Minute)}})
-		miners[realip.FromRequest(r)] = time.Now()
-		w.Write([]byte("ok"))
-	})
-	// /movable/id0
-	router.HandleFunc("/movable/{id0}", func(w http.ResponseWriter, r *http.Request) {
-		id0 := mux.Vars(r)["id0"]
-		query := devices.Find(bson.M{"_id": id0})
-		count, err := query.Count()
 		if err != nil || count < 1 {
-			log.Println(err)
-			return
-		}
-		var device Device
-		err = query.One(&device)
-		if err != nil || device.HasMovable == false {
 			w.Write([]byte("error"))
+			l.Debug("check failed, job isn't this miner's or has expired", "err", err)
 			return
 		}
-		buf := bytes.NewBuffer(make([]byte, 0, 0x140))
-		_, err = buf.Write(device.MSed[:])
-		if err != nil {
-			log.Println(err)
-			return
+		update := bson.M{"$set": bson.M{"checktime": time.Now().Add(time.Minute)}}
+		if offset, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
+			update["$max"] = bson.M{"progress": offset}
 		}
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", "inline; filename=\"movable.sed\"")
-		w.Write(buf.Bytes())
+		devices.Update(bson.M{"_id": id0}, update)
+		if hashrate, err := strconv.ParseFloat(r.URL.Query().Get("hashrate"), 64); err == nil {
+			statsHashrate(realip.FromRequest(r), hashrate)
+		}
+		sawMiner(realip.FromRequest(r), false)
+		w.Write([]byte(answer))
 	})
+	// /movable/id0
+	router.HandleFunc("/movable/{id0}", serveMovable)
 	// POST /upload/id0 w/ file movable and msed
-	router.HandleFunc("/upload/{id0}", func(w http.ResponseWriter, r *http.Request) {
-		id0 := mux.Vars(r)["id0"]
-		file, header, err := r.FormFile("movable")
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		if header.Size != 0x120 && header.Size != 0x140 {
-			w.WriteHeader(400)
-			w.Write([]byte("error"))
-			log.Println(header.Size)
-			return
-		}
-		var movable [0x120]byte
-		_, err = file.Read(movable[:])
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		// verify
-		keyy := movable[0x110:0x11F]
-		sha := sha256.Sum256(keyy)
-		testid0 := fmt.Sprintf("%08x%08x%08x%08x", sha[0:4], sha[4:8], sha[8:12], sha[12:16])
-		log.Println("id0check:", hex.EncodeToString(keyy), hex.EncodeToString(sha[:]), testid0, id0)
-
-		err = devices.Update(bson.M{"_id": id0}, bson.M{"$set": bson.M{"msed": movable, "hasmovable": true, "expirytime": time.Time{}, "wantsbf": false}})
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		minerCollection.Upsert(bson.M{"_id": realip.FromRequest(r)}, bson.M{"$inc": bson.M{"score": 5}})
-
-		for key, conn := range connections {
-			if key == id0 {
-				if err := conn.WriteMessage(websocket.TextMessage, buildMessage("done")); err != nil {
-					log.Println(err)
-					delete(connections, id0)
-					//w.Write([]byte("fail"))
-					//return
-				}
-			}
-		}
-
-		w.Write([]byte("success"))
-
-		file2, header2, err := r.FormFile("msed")
-		if header2.Size != 12 {
-			log.Println(header.Size)
-			return
-		}
-		var msed [12]byte
-		_, err = file2.Read(msed[:])
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		log.Println(header2.Filename)
-		filename := "msed_data_" + id0 + ".bin"
-		err = ioutil.WriteFile("static/mseds/"+filename, msed[:], 0644)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		f, err := os.OpenFile("static/mseds/list", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		_, err = f.WriteString(filename + "\n")
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		f.Close()
-
-	}).Methods("POST")
+	router.HandleFunc("/upload/{id0}", serveUpload).Methods("POST")
 
 	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		renderTemplate("404error", make(jet.VarMap), r, w, nil)
+		w.WriteHeader(404)
+		if err := renderTemplate("404error", make(jet.VarMap), r, w, nil); err != nil {
+			logFrom(r.Context()).Error("rendering 404", "err", err)
+		}
 	})
 
 	// anti abuse task
+	markTaskRun()
 	ticker := time.NewTicker(15 * time.Second)
 	quit := make(chan struct{})
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
-				log.Println("running task")
-				log.Println(miners)
-				for ip, miner := range miners {
-					if miner.Before(time.Now().Add(time.Minute*-5)) == true {
-						delete(miners, ip)
-					}
-				}
-				for ip, miner := range iminers {
-					if miner.Before(time.Now().Add(time.Second*-30)) == true {
-						delete(iminers, ip)
-					}
+				baseLog.Debug("running task")
+				pruneMiners()
+				baseLog.Debug("active miners", "miners", minerCount())
+				abuse.cleanup()
+				for _, limiter := range limiters {
+					limiter.cleanup()
 				}
-				query := devices.Find(bson.M{"wantsbf": true, "hasmovable": bson.M{"$ne": true}, "$or": []bson.M{bson.M{"claimtime": bson.M{"$lt": time.Now()}}, bson.M{"expirytime": bson.M{"$ne": time.Time{}, "$lt": time.Now()}}, bson.M{"expired": true}}})
+				runRetention()
+				refreshMsedModel()
+				expireRanges()
+				collapseIdleSplits()
+				query := devices.Find(bson.M{"wantsbf": true, "hasmovable": bson.M{"$ne": true}, "split": bson.M{"$ne": true}, "$or": []bson.M{bson.M{"claimtime": bson.M{"$lt": time.Now()}}, bson.M{"expirytime": bson.M{"$ne": time.Time{}, "$lt": time.Now()}}, bson.M{"expired": true}}})
 				var theDevices []bson.M
 				err := query.All(&theDevices)
 				if err != nil {
-					log.Println(err)
+					baseLog.Error("finding expired jobs", "err", err)
 					//return
 				}
 				for _, device := range theDevices {
+					id0, _ := device["_id"].(string)
+					l := baseLog.With("id0", id0, "miner", device["miner"])
 					if v, ok := device["checktime"].(time.Time); ok && v.After(time.Now()) {
-						err = devices.Update(bson.M{"_id": device["_id"]}, bson.M{"$set": bson.M{"expirytime": time.Time{}, "wantsbf": false, "expired": true}})
+						var job Device
+						err = devices.FindId(id0).One(&job)
+						if err == nil {
+							attempt := JobAttempt{Miner: job.Miner, ClaimedAt: job.ClaimedAt, Outcome: "expired"}
+							_, err = retryJob(job, attempt)
+						}
 						if err != nil {
-							log.Println(err)
+							l.Error("expiring job", "err", err)
 							//return
 						}
 
 						minerCollection.Upsert(bson.M{"_id": device["miner"]}, bson.M{"$inc": bson.M{"score": -3}})
-
-						for id0, conn := range connections {
-							if id0 == device["_id"] {
-								if err := conn.WriteMessage(websocket.TextMessage, buildMessage("flag")); err != nil {
-									log.Println(err)
-									delete(connections, id0)
-									//return
-								}
-							}
+						if ip, ok := device["miner"].(string); ok {
+							abuse.record(ip, abuseExpiry)
+							statsExpired(ip)
+							recordJobEvent(ip, "expired", -3, 0)
 						}
-						log.Println(device["_id"], "job has expired")
+						jobsMetric.inc("expired")
+						l.Info("job has expired")
 
 					} else {
-						// checktime expired
-						err = devices.Update(bson.M{"_id": device["_id"]}, bson.M{"$set": bson.M{"expirytime": time.Time{}}})
+						// checktime expired, only a job a miner actually holds has anything to requeue
+						if v, ok := device["expirytime"].(time.Time); ok == false || v.IsZero() {
+							continue
+						}
+						err = devices.Update(bson.M{"_id": device["_id"]}, bson.M{"$set": bson.M{"expirytime": time.Time{}}, "$inc": bson.M{"failures": 1}})
 						if err != nil {
-							log.Println(err)
+							l.Error("requeueing job", "err", err)
 							//return
 						}
-
-						for id0, conn := range connections {
-							if id0 == device["_id"] {
-								if err := conn.WriteMessage(websocket.TextMessage, buildMessage("queue")); err != nil {
-									log.Println(err)
-									delete(connections, id0)
-									//return
-								}
-							}
+						if ip, ok := device["miner"].(string); ok {
+							statsExpired(ip)
 						}
-						log.Println(device["_id"], "job has checktimed")
+
+						notify(id0, "queue")
+						l.Info("job has checktimed, requeued")
 					}
 				}
+				markTaskRun()
 			case <-quit:
 				ticker.Stop()
 				return
@@ -1078,7 +1101,7 @@ func main() {
 		}
 	}()
 
-	log.Println("serving on :80 and 443")
+	baseLog.Info("serving on :80 and 443")
 	m := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		HostPolicy: autocert.HostWhitelist("seedhelper.figgyc.uk"),
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Tomasen/realip"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A job can be stopped three ways. None of them change anyone's score, but release and abandon count
+// as cancelled jobs in the miner's reliability (stats.go) and the owner cancelling doesn't count against anyone:
+//
+// release (/release/{id0}, or /cancel/{id0}?kill=n): the miner is shutting down. The job goes back in the
+// queue for any miner and carries on from the offset the miner reported to /check. Followers get "queue".
+//
+// abandon (/abandon/{id0}, or /cancel/{id0}?kill=y): the miner searched as far as it is going to without
+// finding anything. That is a failed attempt, so the job is retried or flagged as in retry.go.
+//
+// user cancel (the websocket "cancel" message): the owner gives up. The job leaves the queue, its miners
+// get "error" from their next /check and followers get "cancelled".
+//
+// Release and abandon are only accepted from the miner holding the job, or for a split job the miner
+// holding the range given by range=.
+
+// /cancel/{id0}?kill=y|n: what older autolaunchers use for both release and abandon. Some send no
+// kill at all when seedminer crashes, which is a release.
+func serveCancel(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("kill") {
+	case "y":
+		stopJob(w, r, true)
+	case "n", "":
+		stopJob(w, r, false)
+	default:
+		abuse.record(realip.FromRequest(r), abuseCancel)
+		writeMinerError(w, r, badRequest("kill must be y or n", nil))
+	}
+}
+
+// /release/{id0}
+func serveRelease(w http.ResponseWriter, r *http.Request) {
+	stopJob(w, r, false)
+}
+
+// /abandon/{id0}
+func serveAbandon(w http.ResponseWriter, r *http.Request) {
+	stopJob(w, r, true)
+}
+
+func stopJob(w http.ResponseWriter, r *http.Request, abandon bool) {
+	id0 := mux.Vars(r)["id0"]
+	ip := realip.FromRequest(r)
+	l := logFrom(r.Context()).With("id0", id0, "abandon", abandon)
+	abuse.record(ip, abuseCancel)
+	var device Device
+	err := devices.FindId(id0).One(&device)
+	if err == mgo.ErrNotFound {
+		writeMinerError(w, r, notFound("no such job"))
+		return
+	} else if err != nil {
+		writeMinerError(w, r, storeError(err))
+		return
+	}
+	if device.Split {
+		err = stopRange(device, ip, r.URL.Query().Get("range"), abandon)
+	} else {
+		err = stopWholeJob(device, ip, abandon)
+	}
+	if err != nil {
+		l.Info("miner couldn't stop job", "err", err)
+		writeMinerError(w, r, err)
+		return
+	}
+	statsCancelled(ip)
+	if abandon {
+		recordJobEvent(ip, "abandoned", 0, 0)
+		jobsMetric.inc("abandoned")
+	} else {
+		recordJobEvent(ip, "released", 0, 0)
+		jobsMetric.inc("released")
+	}
+	l.Info("miner stopped job", "range", r.URL.Query().Get("range"))
+	w.Write([]byte("success"))
+}
+
+func stopWholeJob(device Device, ip string, abandon bool) error {
+	if device.Miner != ip || device.WantsBF == false || device.HasMovable || (device.ExpiryTime == time.Time{}) {
+		return forbidden("this miner isn't mining this job")
+	}
+	if abandon {
+		if _, err := retryJob(device, JobAttempt{Miner: ip, ClaimedAt: device.ClaimedAt, Outcome: "abandoned"}); err != nil {
+			return storeError(err)
+		}
+		return nil
+	}
+	searchedTo := device.SearchedTo
+	if device.Progress > searchedTo {
+		searchedTo = device.Progress
+	}
+	err := devices.Update(bson.M{"_id": device.ID0, "miner": ip}, bson.M{"$set": bson.M{"expirytime": time.Time{}, "miner": "", "searchedto": searchedTo}})
+	if err == mgo.ErrNotFound {
+		return forbidden("this miner isn't mining this job")
+	} else if err != nil {
+		return storeError(err)
+	}
+	notify(device.ID0, "queue")
+	return nil
+}
+
+// stopRange releases or abandons one range, abandoning the last unsearched range is a failed attempt at the job
+func stopRange(device Device, ip string, index string, abandon bool) error {
+	all, err := cancelRange(device.ID0, ip, index, abandon)
+	if err != nil || all == false {
+		return err
+	}
+	attempt := JobAttempt{Miner: ip, ClaimedAt: device.ClaimedAt, Outcome: "searched", SearchedTo: device.SearchedTo + rangeCount*rangeSize}
+	if _, err := retryJob(device, attempt); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// cancelJob is the owner cancelling their job, a finished job is left alone
+func cancelJob(id0 string) error {
+	err := devices.Update(bson.M{"_id": id0, "hasmovable": bson.M{"$ne": true}}, bson.M{"$set": bson.M{
+		"cancelled": true, "cancelledtime": time.Now(), "wantsbf": false, "expirytime": time.Time{}, "miner": "", "split": false,
+	}})
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return storeError(err)
+	}
+	if err := clearRanges(id0); err != nil {
+		return storeError(err)
+	}
+	notify(id0, "cancelled")
+	return nil
+}
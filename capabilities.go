@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tomasen/realip"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Miners can describe themselves with query parameters on /getwork, /getrange and /claim: version (the
+// autolauncher's version), gpu, benchmark (the hashrate of its benchmark run), maxtime (the most
+// seconds it will spend on one job) and ranges=1 (if its job is split while it mines it whole, it
+// reads "range <range> <start> <end>" from /check and stops at end, /getrange implies it).
+// A launcher older than SEEDHELPER_MIN_LAUNCHER_VERSION, by default the version in
+// static/autolauncher_version, is turned away with 426 and a body starting "upgrade". So is a miner
+// that sends no version, but with the body it would be rate limited with: launchers from before
+// versions were sent act on the body whatever the status, so they wait, and update themselves
+// against static/autolauncher_version when they are restarted.
+var minLauncherVersion = loadMinLauncherVersion()
+
+// the hashrate that is worth one range per claim, faster miners get several neighbouring ranges
+// merged into one. It is off (0, everyone gets one range) by default because the shipped
+// autolaunchers don't report a benchmark, so only the hashrate seen while mining would count.
+var rangeHashrate = envInt("SEEDHELPER_RANGE_HASHRATE", 0)
+
+// Capabilities : what a miner said about itself on its last /getwork or /getrange
+type Capabilities struct {
+	Version    string
+	GPU        string
+	Benchmark  float64
+	MaxJobTime int // seconds, 0 for no limit
+	Ranges     bool
+	Updated    time.Time
+}
+
+func loadMinLauncherVersion() string {
+	if v := os.Getenv("SEEDHELPER_MIN_LAUNCHER_VERSION"); v != "" {
+		return v
+	}
+	v, err := ioutil.ReadFile("static/autolauncher_version")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(v))
+}
+
+// compareVersions compares dotted version numbers, a missing or non-numeric part counts as 0
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseCapabilities reads the capability parameters, declared is false if there weren't any
+func parseCapabilities(r *http.Request) (caps Capabilities, declared bool, err error) {
+	q := r.URL.Query()
+	caps.Version = strings.TrimSpace(q.Get("version"))
+	caps.GPU = strings.TrimSpace(q.Get("gpu"))
+	if len(caps.GPU) > 100 {
+		caps.GPU = caps.GPU[:100]
+	}
+	if v := q.Get("benchmark"); v != "" {
+		caps.Benchmark, err = strconv.ParseFloat(v, 64)
+		if err != nil || caps.Benchmark < 0 {
+			return caps, true, badRequest("benchmark must be a hashrate", err)
+		}
+	}
+	if v := q.Get("maxtime"); v != "" {
+		caps.MaxJobTime, err = strconv.Atoi(v)
+		if err != nil || caps.MaxJobTime < 0 {
+			return caps, true, badRequest("maxtime must be a number of seconds", err)
+		}
+	}
+	caps.Ranges = q.Get("ranges") == "1" || r.URL.Path == "/getrange"
+	declared = caps.Version != "" || caps.GPU != "" || caps.Benchmark > 0 || caps.MaxJobTime > 0 || caps.Ranges
+	return caps, declared, nil
+}
+
+// negotiate is the start of /getwork, /getrange and /claim: it saves what the miner declared, or looks
+// up what it declared before, and answers outdated launchers itself, in which case ok is false
+func negotiate(w http.ResponseWriter, r *http.Request) (caps Capabilities, ok bool) {
+	ip := realip.FromRequest(r)
+	caps, declared, err := parseCapabilities(r)
+	if err != nil {
+		writeMinerError(w, r, err)
+		return caps, false
+	}
+	if caps.Version == "" && minLauncherVersion != "" {
+		logFrom(r.Context()).Debug("launcher without a version turned away")
+		w.WriteHeader(426)
+		w.Write([]byte(limitedBody(r.URL.Path)))
+		return caps, false
+	}
+	if declared == false {
+		return storedCapabilities(ip), true
+	}
+	if minLauncherVersion != "" && compareVersions(caps.Version, minLauncherVersion) < 0 {
+		logFrom(r.Context()).Info("outdated launcher turned away", "version", caps.Version)
+		w.WriteHeader(426)
+		w.Write([]byte("upgrade: this autolauncher is version " + caps.Version + " but " + minLauncherVersion + " is needed, download it again from /static/seedminer_autolauncher.py"))
+		return caps, false
+	}
+	stored := storedCapabilities(ip)
+	caps.Updated = stored.Updated
+	if caps == stored {
+		// launchers declare the same thing on every poll, only changes are written
+		return caps, true
+	}
+	caps.Updated = time.Now()
+	if _, err := minerCollection.Upsert(bson.M{"_id": ip}, bson.M{"$set": bson.M{"capabilities": caps}}); err != nil {
+		logFrom(r.Context()).Error("saving capabilities", "err", err)
+	}
+	return caps, true
+}
+
+// storedCapabilities is what ip last declared, nothing if it never has
+func storedCapabilities(ip string) Capabilities {
+	var miner Miner
+	minerCollection.FindId(ip).Select(bson.M{"capabilities": 1}).One(&miner)
+	return miner.Capabilities
+}
+
+// maxJobTime is how long a miner may hold a job or range, the usual hour unless it asked for less
+func (caps Capabilities) maxJobTime() time.Duration {
+	limit := time.Duration(caps.MaxJobTime) * time.Second
+	if limit > 0 && limit < time.Hour {
+		return limit
+	}
+	return time.Hour
+}
+
+// rangesFor is how many neighbouring ranges a miner gets in one claim, from its benchmark or failing
+// that the hashrate it reports while mining
+func rangesFor(ip string, caps Capabilities) int {
+	if rangeHashrate <= 0 {
+		return 1
+	}
+	speed := caps.Benchmark
+	if speed == 0 {
+		var miner Miner
+		if err := minerCollection.FindId(ip).Select(bson.M{"hashrate": 1}).One(&miner); err == nil {
+			speed = miner.Hashrate
+		}
+	}
+	n := int(speed / float64(rangeHashrate))
+	if n < 1 {
+		return 1
+	} else if n > rangeCount {
+		return rangeCount
+	}
+	return n
+}
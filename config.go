@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt reads an integer setting from the environment, falling back to def
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		baseLog.Warn("bad setting", "name", name, "value", v)
+		return def
+	}
+	return i
+}
+
+// envDuration reads a duration setting such as "10m" from the environment, falling back to def
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		baseLog.Warn("bad setting", "name", name, "value", v)
+		return def
+	}
+	return d
+}
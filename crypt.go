@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LFCS values and movable.seds are console secrets, so they are stored with envelope encryption:
+// each value gets its own data key, and the data key is stored wrapped by a key encryption key from
+// SEEDHELPER_ENCRYPTION_KEYS=id:base64key,id:base64key. The first key wraps new values, the rest are
+// only used to read values wrapped before a rotation, which rewrapSecrets moves onto the first key.
+// The ID0 and field are authenticated with the data, so a value copied onto another device or field
+// doesn't open. Without any keys the values are stored in plaintext like before.
+var encryptionKeys, primaryKeyID = loadEncryptionKeys()
+
+// Sealed : a secret encrypted with its own data key
+type Sealed struct {
+	KeyID      string // which key encryption key wrapped the data key
+	WrappedKey []byte
+	Data       []byte // nonce then ciphertext, authenticating the ID0 and field it is stored in
+}
+
+// sealedFor is the additional data that binds a value to where it is stored
+func sealedFor(id0 string, field string) []byte {
+	return []byte(id0 + "/" + field)
+}
+
+func loadEncryptionKeys() (map[string][]byte, string) {
+	keys := map[string][]byte{}
+	primary := ""
+	env := os.Getenv("SEEDHELPER_ENCRYPTION_KEYS")
+	if env == "" {
+		return keys, ""
+	}
+	for _, entry := range strings.Split(env, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			panic("SEEDHELPER_ENCRYPTION_KEYS entries must be id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			panic("encryption key " + parts[0] + " must be 32 bytes of base64")
+		}
+		keys[parts[0]] = key
+		if primary == "" {
+			primary = parts[0]
+		}
+	}
+	return keys, primary
+}
+
+func gcmSeal(key []byte, plain []byte, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, additional), nil
+}
+
+func gcmOpen(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+// seal encrypts plain, to be stored in id0's field, under a new data key wrapped by the primary key
+func seal(plain []byte, id0 string, field string) (*Sealed, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	data, err := gcmSeal(dataKey, plain, sealedFor(id0, field))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := gcmSeal(encryptionKeys[primaryKeyID], dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealed{KeyID: primaryKeyID, WrappedKey: wrapped, Data: data}, nil
+}
+
+func (s *Sealed) dataKey() ([]byte, error) {
+	kek, ok := encryptionKeys[s.KeyID]
+	if ok == false {
+		return nil, errors.New("no encryption key " + s.KeyID)
+	}
+	return gcmOpen(kek, s.WrappedKey, nil)
+}
+
+// open decrypts s, which must have been sealed for id0's field
+func (s *Sealed) open(id0 string, field string) ([]byte, error) {
+	dataKey, err := s.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, s.Data, sealedFor(id0, field))
+}
+
+// rewrap moves s onto the primary key, only the data key is wrapped again
+func (s *Sealed) rewrap() (*Sealed, error) {
+	dataKey, err := s.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := gcmSeal(encryptionKeys[primaryKeyID], dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealed{KeyID: primaryKeyID, WrappedKey: wrapped, Data: s.Data}, nil
+}
+
+// setSecret adds plain to a $set as id0's field, sealed in field+"sealed" when encryption is on
+// in which case the plaintext field is added to unset
+func setSecret(set bson.M, unset bson.M, id0 string, field string, plain []byte) error {
+	if primaryKeyID == "" {
+		set[field] = plain
+		return nil
+	}
+	sealed, err := seal(plain, id0, field+"sealed")
+	if err != nil {
+		return err
+	}
+	set[field+"sealed"] = sealed
+	if unset != nil {
+		unset[field] = ""
+	}
+	return nil
+}
+
+// deviceLFCS is a device's LFCS whichever way it was stored
+func deviceLFCS(device Device) ([8]byte, error) {
+	var lfcs [8]byte
+	if device.LFCSSealed == nil {
+		return device.LFCS, nil
+	}
+	plain, err := device.LFCSSealed.open(device.ID0, "lfcssealed")
+	if err != nil {
+		return lfcs, err
+	}
+	copy(lfcs[:], plain)
+	return lfcs, nil
+}
+
+// deviceMSed is a device's movable.sed whichever way it was stored
+func deviceMSed(device Device) ([0x140]byte, error) {
+	var msed [0x140]byte
+	if device.MSedSealed == nil {
+		return device.MSed, nil
+	}
+	plain, err := device.MSedSealed.open(device.ID0, "msedsealed")
+	if err != nil {
+		return msed, err
+	}
+	copy(msed[:], plain)
+	return msed, nil
+}
+
+// rewrapSecrets encrypts plaintext secrets left from before encryption was turned on and moves secrets
+// wrapped by old keys onto the primary key. It runs in the background at startup, so each write only
+// goes through if the device still has the values it read, a device resubmitted or uploaded to
+// meanwhile already has freshly sealed ones.
+func rewrapSecrets() {
+	if primaryKeyID == "" {
+		baseLog.Warn("SEEDHELPER_ENCRYPTION_KEYS isn't set, LFCS values and movable.seds are stored in plaintext")
+		return
+	}
+	start := time.Now()
+	iter := devices.Find(bson.M{"$or": []bson.M{
+		{"lfcs": bson.M{"$exists": true}},
+		{"msed": bson.M{"$exists": true}},
+		{"lfcssealed": bson.M{"$exists": true}, "lfcssealed.keyid": bson.M{"$ne": primaryKeyID}},
+		{"msedsealed": bson.M{"$exists": true}, "msedsealed.keyid": bson.M{"$ne": primaryKeyID}},
+	}}).Iter()
+	var device Device
+	n, changed := 0, 0
+	for iter.Next(&device) {
+		set, unset := bson.M{}, bson.M{}
+		selector := rewrapSelector(device)
+		err := rewrapDevice(device, set, unset)
+		if err == nil {
+			update := bson.M{"$unset": unset}
+			if len(set) > 0 {
+				update["$set"] = set
+			}
+			err = devices.Update(selector, update)
+		}
+		if err == mgo.ErrNotFound {
+			changed++
+		} else if err != nil {
+			baseLog.Error("rewrapping secrets", "id0", device.ID0, "err", err)
+		} else {
+			n++
+		}
+		device = Device{}
+	}
+	if err := iter.Close(); err != nil {
+		baseLog.Error("rewrapping secrets", "err", err)
+	}
+	baseLog.Info("rewrapped secrets", "devices", n, "changed", changed, "took", time.Since(start))
+}
+
+// rewrapSelector matches device only while its secrets are the ones that were read
+func rewrapSelector(device Device) bson.M {
+	selector := bson.M{"_id": device.ID0}
+	if device.LFCSSealed != nil {
+		selector["lfcssealed.data"] = device.LFCSSealed.Data
+	} else {
+		selector["lfcssealed"] = nil
+	}
+	if device.MSedSealed != nil {
+		selector["msedsealed.data"] = device.MSedSealed.Data
+	} else {
+		selector["msedsealed"] = nil
+	}
+	// a zero value was either stored as zeros or not stored at all
+	if device.LFCS == [8]byte{} {
+		selector["lfcs"] = bson.M{"$in": []interface{}{device.LFCS, nil}}
+	} else {
+		selector["lfcs"] = device.LFCS
+	}
+	if device.MSed == [0x140]byte{} {
+		selector["msed"] = bson.M{"$in": []interface{}{device.MSed, nil}}
+	} else {
+		selector["msed"] = device.MSed
+	}
+	return selector
+}
+
+func rewrapDevice(device Device, set bson.M, unset bson.M) error {
+	if device.LFCSSealed != nil {
+		sealed, err := device.LFCSSealed.rewrap()
+		if err != nil {
+			return err
+		}
+		set["lfcssealed"] = sealed
+		unset["lfcs"] = ""
+	} else if device.LFCS != [8]byte{} {
+		if err := setSecret(set, unset, device.ID0, "lfcs", device.LFCS[:]); err != nil {
+			return err
+		}
+	} else {
+		unset["lfcs"] = ""
+	}
+	if device.MSedSealed != nil {
+		sealed, err := device.MSedSealed.rewrap()
+		if err != nil {
+			return err
+		}
+		set["msedsealed"] = sealed
+		unset["msed"] = ""
+	} else if device.MSed != [0x140]byte{} {
+		if err := setSecret(set, unset, device.ID0, "msed", device.MSed[:]); err != nil {
+			return err
+		}
+	} else {
+		unset["msed"] = ""
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// useKeys swaps the key encryption keys for the length of a test
+func useKeys(t *testing.T, primary string, keys map[string][]byte) {
+	oldKeys, oldPrimary := encryptionKeys, primaryKeyID
+	encryptionKeys, primaryKeyID = keys, primary
+	t.Cleanup(func() {
+		encryptionKeys, primaryKeyID = oldKeys, oldPrimary
+	})
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+const testID0 = "0123456789abcdef0123456789abcdef"
+
+func TestSealOpen(t *testing.T) {
+	useKeys(t, "a", map[string][]byte{"a": testKey(1)})
+	plain := []byte("an lfcs")
+	sealed, err := seal(plain, testID0, "lfcssealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.KeyID != "a" || bytes.Contains(sealed.Data, plain) {
+		t.Fatalf("sealed with %q, data %x", sealed.KeyID, sealed.Data)
+	}
+	got, err := sealed.open(testID0, "lfcssealed")
+	if err != nil || bytes.Equal(got, plain) == false {
+		t.Fatalf("open = %q, %v", got, err)
+	}
+}
+
+func TestOpenWrongPlace(t *testing.T) {
+	useKeys(t, "a", map[string][]byte{"a": testKey(1)})
+	sealed, err := seal([]byte("an lfcs"), testID0, "lfcssealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ id0, field string }{
+		{"fedcba9876543210fedcba9876543210", "lfcssealed"},
+		{testID0, "msedsealed"},
+		{"", ""},
+	} {
+		if _, err := sealed.open(c.id0, c.field); err == nil {
+			t.Errorf("opened as %s/%s", c.id0, c.field)
+		}
+	}
+}
+
+func TestRewrapRotation(t *testing.T) {
+	useKeys(t, "old", map[string][]byte{"old": testKey(1)})
+	sealed, err := seal([]byte("a movable"), testID0, "msedsealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate: new values and rewraps use "new", "old" is kept to read what it wrapped
+	useKeys(t, "new", map[string][]byte{"new": testKey(2), "old": testKey(1)})
+	rewrapped, err := sealed.rewrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.KeyID != "new" || bytes.Equal(rewrapped.Data, sealed.Data) == false {
+		t.Fatalf("rewrapped onto %q, data changed %v", rewrapped.KeyID, bytes.Equal(rewrapped.Data, sealed.Data) == false)
+	}
+
+	// once everything is rewrapped the old key can go
+	useKeys(t, "new", map[string][]byte{"new": testKey(2)})
+	got, err := rewrapped.open(testID0, "msedsealed")
+	if err != nil || string(got) != "a movable" {
+		t.Fatalf("open after rotation = %q, %v", got, err)
+	}
+	if _, err := sealed.open(testID0, "msedsealed"); err == nil {
+		t.Fatal("opened a value wrapped by a removed key")
+	}
+	if _, err := rewrapped.open("fedcba9876543210fedcba9876543210", "msedsealed"); err == nil {
+		t.Fatal("rewrapped value opened for another ID0")
+	}
+}
+
+func TestSetSecret(t *testing.T) {
+	useKeys(t, "", map[string][]byte{})
+	set, unset := bson.M{}, bson.M{}
+	if err := setSecret(set, unset, testID0, "lfcs", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if string(set["lfcs"].([]byte)) != "plain" || len(unset) != 0 {
+		t.Fatalf("without keys set %v unset %v", set, unset)
+	}
+
+	useKeys(t, "a", map[string][]byte{"a": testKey(1)})
+	set, unset = bson.M{}, bson.M{}
+	if err := setSecret(set, unset, testID0, "lfcs", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	sealed, ok := set["lfcssealed"].(*Sealed)
+	if ok == false || set["lfcs"] != nil || unset["lfcs"] == nil {
+		t.Fatalf("with keys set %v unset %v", set, unset)
+	}
+	lfcs, err := deviceLFCS(Device{ID0: testID0, LFCSSealed: sealed})
+	if err != nil || string(lfcs[:5]) != "plain" {
+		t.Fatalf("deviceLFCS = %q, %v", lfcs, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// httpError : an error that knows which status code and message it should be reported with
+type httpError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *httpError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *httpError) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(message string, err error) error {
+	return &httpError{Status: 400, Message: message, Err: err}
+}
+
+func forbidden(message string) error {
+	return &httpError{Status: 403, Message: message}
+}
+
+func gone(message string) error {
+	return &httpError{Status: 410, Message: message}
+}
+
+func notFound(message string) error {
+	return &httpError{Status: 404, Message: message}
+}
+
+// storeError is for mongo failures, the user can't do anything about those so the details are only logged
+func storeError(err error) error {
+	return &httpError{Status: 503, Message: "store unavailable", Err: err}
+}
+
+// writeError reports err to the client, anything that isn't an httpError is a 500
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*httpError)
+	if ok == false {
+		e = &httpError{Status: 500, Message: "internal error", Err: err}
+	}
+	if e.Status >= 500 {
+		logFrom(r.Context()).Error(e.Message, "status", e.Status, "err", e.Err)
+	} else {
+		logFrom(r.Context()).Debug(e.Message, "status", e.Status, "err", e.Err)
+	}
+	w.WriteHeader(e.Status)
+	w.Write([]byte(e.Message))
+}
+
+// writeMinerError is writeError for the miner and bot endpoints, whose scripts look for a plain "error"
+func writeMinerError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*httpError)
+	if ok == false {
+		e = &httpError{Status: 500, Message: "internal error", Err: err}
+	}
+	logFrom(r.Context()).Warn(e.Message, "status", e.Status, "err", e.Err)
+	w.WriteHeader(e.Status)
+	w.Write([]byte("error"))
+}
+
+// reason is what an error says to a client, internals of anything but an httpError are hidden
+func reason(err error) string {
+	if e, ok := err.(*httpError); ok {
+		return e.Message
+	}
+	return "internal error"
+}
+
+// recoverer turns a panic in a handler into a 500 instead of taking the whole server down
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logFrom(r.Context()).Error("panic", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+				// this fails harmlessly if the handler already wrote or hijacked the connection
+				w.WriteHeader(500)
+				w.Write([]byte("internal error"))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// msed3 values of new 3DS consoles have this bit set
+const msedNewBit = 0x80000000
+
+// smallest search radius suggested to miners, in msed3 steps
+const minMsedRadius = 10
+
+// how often the estimation model is rebuilt from the msed_data contributions
+const msedModelInterval = time.Hour
+
+// msedNode : one known LFCS and the fine tune that turns LFCS/5 into its real msed3
+type msedNode struct {
+	LFCS     int32
+	FineTune int32
+}
+
+// msedModel : seedminer's lfcs.dat and lfcs_new.dat, built from the contributions instead of shipped,
+// plus a straight line fit per console type for LFCSes outside the known ones
+type msedModel struct {
+	old    []msedNode
+	new    []msedNode
+	oldFit MsedFit
+	newFit MsedFit
+	built  time.Time
+}
+
+var currentMsedModel *msedModel
+var msedModelLock sync.RWMutex
+
+// persisted fits and accuracy, in the document with _id "msed"
+var msedModels *mgo.Collection
+
+// MsedFit : running sums for a least squares fit of fine tune against LFCS, and how close
+// the estimates were for uploads that arrived after the model was built. The accuracy and the
+// fitted line are persisted, the sums are always worked out from the contributions that still exist.
+type MsedFit struct {
+	Points       int     `bson:"-"`
+	SumX         float64 `bson:"-"`
+	SumY         float64 `bson:"-"`
+	SumXY        float64 `bson:"-"`
+	SumXX        float64 `bson:"-"`
+	Checked      int
+	SumAbsError  float64
+	SumSqError   float64
+	WithinRadius int
+}
+
+func (f *MsedFit) add(node msedNode) {
+	x, y := float64(node.LFCS), float64(node.FineTune)
+	f.Points++
+	f.SumX += x
+	f.SumY += y
+	f.SumXY += x * y
+	f.SumXX += x * x
+}
+
+// line is the fit's slope and intercept, ok is false until there are two different LFCSes
+func (f MsedFit) line() (slope float64, intercept float64, ok bool) {
+	n := float64(f.Points)
+	d := n*f.SumXX - f.SumX*f.SumX
+	if f.Points < 2 || d == 0 {
+		return 0, 0, false
+	}
+	slope = (n*f.SumXY - f.SumX*f.SumY) / d
+	return slope, (f.SumY - slope*f.SumX) / n, true
+}
+
+// MsedFitReport : what /mseds/v1/model says about one console type
+type MsedFitReport struct {
+	Points       int     `json:"points"`
+	Slope        float64 `json:"slope"`
+	Intercept    float64 `json:"intercept"`
+	Checked      int     `json:"checked"`
+	MeanAbsError float64 `json:"meanAbsError"`
+	RMSError     float64 `json:"rmsError"`
+	WithinRadius float64 `json:"withinRadius"`
+}
+
+func (f MsedFit) report() MsedFitReport {
+	slope, intercept, _ := f.line()
+	r := MsedFitReport{Points: f.Points, Slope: slope, Intercept: intercept, Checked: f.Checked}
+	if f.Checked > 0 {
+		r.MeanAbsError = f.SumAbsError / float64(f.Checked)
+		r.RMSError = math.Sqrt(f.SumSqError / float64(f.Checked))
+		r.WithinRadius = float64(f.WithinRadius) / float64(f.Checked)
+	}
+	return r
+}
+
+// fineTune is the lfcs.dat value for a contribution
+func (m MsedRecord) fineTune() int32 {
+	return int32(m.LFCS)/5 - int32(uint32(m.MSed3)&^msedNewBit)
+}
+
+func (m MsedRecord) isNew() bool {
+	return uint32(m.MSed3)&msedNewBit != 0
+}
+
+// buildMsedModel reads every contribution into a new model, so a deleted contribution stops
+// counting the next time it is built. The accuracy history comes from the persisted document.
+func buildMsedModel() (*msedModel, error) {
+	model := &msedModel{built: time.Now()}
+	var record MsedRecord
+	iter := msedData.Find(nil).Select(bson.M{"lfcs": 1, "msed3": 1}).Iter()
+	for iter.Next(&record) {
+		node := msedNode{LFCS: int32(record.LFCS), FineTune: record.fineTune()}
+		if record.isNew() {
+			model.new = append(model.new, node)
+		} else {
+			model.old = append(model.old, node)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	for _, nodes := range [][]msedNode{model.old, model.new} {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].LFCS < nodes[j].LFCS })
+	}
+
+	var saved struct {
+		Old MsedFit
+		New MsedFit
+	}
+	err := msedModels.FindId("msed").One(&saved)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	model.oldFit, model.newFit = saved.Old, saved.New
+	for _, node := range model.old {
+		model.oldFit.add(node)
+	}
+	for _, node := range model.new {
+		model.newFit.add(node)
+	}
+	return model, nil
+}
+
+// fitParams adds fit's line to a $set under prefix, for anything reading the model from the store
+func fitParams(set bson.M, prefix string, fit MsedFit, built time.Time) {
+	slope, intercept, _ := fit.line()
+	set[prefix+"points"] = fit.Points
+	set[prefix+"slope"] = slope
+	set[prefix+"intercept"] = intercept
+	set[prefix+"fitted"] = built
+}
+
+// staleMsedModel makes the anti abuse task rebuild the model on its next run, after a contribution is deleted
+func staleMsedModel() {
+	msedModelLock.Lock()
+	defer msedModelLock.Unlock()
+	if currentMsedModel == nil {
+		return
+	}
+	model := *currentMsedModel
+	model.built = time.Time{}
+	currentMsedModel = &model
+}
+
+// refreshMsedModel rebuilds the model if it is due, called from the anti abuse task
+func refreshMsedModel() {
+	msedModelLock.RLock()
+	current := currentMsedModel
+	msedModelLock.RUnlock()
+	if current != nil && time.Since(current.built) < msedModelInterval {
+		return
+	}
+	model, err := buildMsedModel()
+	if err != nil {
+		baseLog.Error("building msed model", "err", err)
+		return
+	}
+	msedModelLock.Lock()
+	currentMsedModel = model
+	msedModelLock.Unlock()
+	set := bson.M{}
+	fitParams(set, "old.", model.oldFit, model.built)
+	fitParams(set, "new.", model.newFit, model.built)
+	if _, err := msedModels.UpsertId("msed", bson.M{"$set": set}); err != nil {
+		baseLog.Error("saving msed model", "err", err)
+	}
+	baseLog.Debug("built msed model", "old", len(model.old), "new", len(model.new))
+}
+
+// estimate is seedminer's getmsed3estimate: interpolate the fine tune between the known LFCSes
+// either side of n. radius is how far the answer is likely to be, from how much the fine tune
+// changes between those two.
+func (m *msedModel) estimate(n int32, isNew bool) (msed3 uint32, radius int32, ok bool) {
+	nodes, newBit := m.old, uint32(0)
+	if isNew {
+		nodes, newBit = m.new, msedNewBit
+	}
+	if len(nodes) == 0 {
+		return 0, 0, false
+	}
+	fit := m.oldFit
+	if isNew {
+		fit = m.newFit
+	}
+	i := sort.Search(len(nodes), func(i int) bool { return n < nodes[i].LFCS })
+	var fineTune int32
+	radius = minMsedRadius
+	slope, intercept, fitted := fit.line()
+	switch {
+	case (i == len(nodes) || i == 0) && fitted:
+		// past the known LFCSes the fit is better than repeating the nearest one
+		fineTune = int32(math.Round(slope*float64(n) + intercept))
+		if fit.Checked > 0 {
+			radius = int32(math.Max(minMsedRadius, math.Ceil(2*math.Sqrt(fit.SumSqError/float64(fit.Checked)))))
+		}
+	case i == len(nodes):
+		fineTune = nodes[len(nodes)-1].FineTune
+	case i == 0:
+		fineTune = nodes[0].FineTune
+	default:
+		lo, hi := nodes[i-1], nodes[i]
+		xs, xl := int64(n-lo.LFCS), int64(hi.LFCS-lo.LFCS)
+		yl := int64(hi.FineTune - lo.FineTune)
+		fineTune = int32(xs*yl/xl) + lo.FineTune
+		if yl < 0 {
+			yl = -yl
+		}
+		if int32(yl) > radius {
+			radius = int32(yl)
+		}
+	}
+	return uint32(n/5-fineTune) | newBit, radius, true
+}
+
+// part1Estimate works out the msed3 estimate for the first 8 bytes of a movable_part1.sed,
+// the LFCS is the first 4 and byte 4 is 2 on new 3DS consoles, which is what seedminer checks
+func part1Estimate(part1LFCS []byte) (uint32, int32, bool) {
+	msedModelLock.RLock()
+	model := currentMsedModel
+	msedModelLock.RUnlock()
+	if model == nil {
+		return 0, 0, false
+	}
+	return model.estimate(int32(binary.LittleEndian.Uint32(part1LFCS[0:4])), part1LFCS[4] == 2)
+}
+
+// setEstimateHeaders adds the msed3 estimate to a /part1 response. The part1 itself is left as it
+// always was, seedminer hands its first 16 bytes to bfcl as the KeyY.
+func setEstimateHeaders(h http.Header, part1LFCS []byte) {
+	msed3, radius, ok := part1Estimate(part1LFCS)
+	if ok == false {
+		return
+	}
+	h.Set("X-Seedhelper-Msed3-Estimate", strconv.FormatUint(uint64(msed3), 16))
+	h.Set("X-Seedhelper-Msed3-Radius", strconv.Itoa(int(radius)))
+}
+
+// insertNode is nodes with node added in order, as a new slice because readers may hold the old one
+func insertNode(nodes []msedNode, node msedNode) []msedNode {
+	i := sort.Search(len(nodes), func(i int) bool { return node.LFCS < nodes[i].LFCS })
+	out := make([]msedNode, 0, len(nodes)+1)
+	out = append(out, nodes[:i]...)
+	out = append(out, node)
+	return append(out, nodes[i:]...)
+}
+
+// learnMsed adds a new contribution to the model as it arrives, after scoring the estimate
+// the model would have given for it
+func learnMsed(record MsedRecord) {
+	inc, set := learnMsedLocked(record)
+	if len(set) == 0 {
+		return
+	}
+	update := bson.M{"$set": set}
+	if len(inc) > 0 {
+		update["$inc"] = inc
+	}
+	// saved outside the lock so /part1 doesn't wait on the database
+	if _, err := msedModels.UpsertId("msed", update); err != nil {
+		baseLog.Error("saving msed model", "err", err)
+	}
+}
+
+// learnMsedLocked adds record to the model and returns the accuracy changes and the new line to persist
+func learnMsedLocked(record MsedRecord) (inc bson.M, set bson.M) {
+	msedModelLock.Lock()
+	defer msedModelLock.Unlock()
+	if currentMsedModel == nil {
+		return nil, nil
+	}
+	model := *currentMsedModel
+	fit, nodes, prefix := &model.oldFit, &model.old, "old."
+	if record.isNew() {
+		fit, nodes, prefix = &model.newFit, &model.new, "new."
+	}
+	node := msedNode{LFCS: int32(record.LFCS), FineTune: record.fineTune()}
+	inc, set = bson.M{}, bson.M{}
+
+	if estimate, radius, ok := model.estimate(node.LFCS, record.isNew()); ok {
+		miss := math.Abs(float64(int32(estimate&^msedNewBit)) - float64(int32(uint32(record.MSed3)&^msedNewBit)))
+		fit.Checked++
+		fit.SumAbsError += miss
+		fit.SumSqError += miss * miss
+		inc[prefix+"checked"] = 1
+		inc[prefix+"sumabserror"] = miss
+		inc[prefix+"sumsqerror"] = miss * miss
+		if miss <= float64(radius) {
+			fit.WithinRadius++
+			inc[prefix+"withinradius"] = 1
+		}
+	}
+
+	fit.add(node)
+	fitParams(set, prefix, *fit, time.Now())
+	*nodes = insertNode(*nodes, node)
+	currentMsedModel = &model
+	return inc, set
+}
+
+// /mseds/v1/model: the fits and how accurate the estimates have been against real uploads
+func serveMsedModel(w http.ResponseWriter, r *http.Request) {
+	msedModelLock.RLock()
+	model := currentMsedModel
+	msedModelLock.RUnlock()
+	if model == nil {
+		writeError(w, r, &httpError{Status: 503, Message: "model not built yet"})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"built": model.built,
+		"old":   model.oldFit.report(),
+		"new":   model.newFit.report(),
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// how often an idle event stream gets a comment so proxies don't time it out
+const eventsKeepalive = 30 * time.Second
+
+// currentStatus looks up the status frame for id0, the same one the websocket sends
+func currentStatus(id0 string) ([]byte, error) {
+	if validID0(id0) == false {
+		return nil, badRequest("invalid id0", nil)
+	}
+	var device Device
+	err := devices.Find(bson.M{"_id": id0}).One(&device)
+	if err == mgo.ErrNotFound {
+		return nil, notFound("no such device")
+	} else if err != nil {
+		return nil, storeError(err)
+	}
+	return encodeMessage(deviceMessage(device)), nil
+}
+
+// /status/{id0}: one status frame as JSON, for clients that poll
+func serveDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	message, err := currentStatus(mux.Vars(r)["id0"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(message)
+}
+
+// /events/{id0}: the current status frame and then every update, as server sent events
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	id0 := mux.Vars(r)["id0"]
+	message, err := currentStatus(id0)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	c := newWatcher()
+	watch(id0, c)
+	atomic.AddInt64(&openEventStreams, 1)
+	defer func() {
+		atomic.AddInt64(&openEventStreams, -1)
+		removeConnection(c)
+		c.close()
+	}()
+	ticker := time.NewTicker(eventsKeepalive)
+	defer ticker.Stop()
+
+	for {
+		// the server's write timeout is meant for normal requests, this one is written to as things happen
+		if err := rc.SetWriteDeadline(time.Now().Add(socketWriteWait)); err != nil {
+			logFrom(r.Context()).Error("event stream deadline", "err", err)
+			return
+		}
+		if message != nil {
+			fmt.Fprintf(w, "data: %s\n\n", message)
+			message = nil
+		} else {
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			logFrom(r.Context()).Debug("event stream closed", "err", err)
+			return
+		}
+		select {
+		case message = <-c.send:
+		case <-ticker.C:
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
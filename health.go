@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// when the anti abuse task last finished, as unix nanoseconds
+var lastTaskRun int64
+
+// how stale the anti abuse task can be before /readyz fails, it normally runs every 15 seconds
+var maxTaskAge = envDuration("SEEDHELPER_READY_TASK_AGE", time.Minute)
+
+// templates that must load for the site to work
+var requiredTemplates = []string{"home", "404error", "leaderboard", "miner"}
+
+func markTaskRun() {
+	atomic.StoreInt64(&lastTaskRun, time.Now().UnixNano())
+}
+
+// botIsUp is whether the part1 bot has asked for friend codes recently
+func botIsUp() bool {
+	return lastBotInteraction.After(time.Now().Add(time.Minute * -5))
+}
+
+// CheckResult : outcome of one readiness check
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// /healthz: the process is up and serving
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// /readyz: mongo is reachable, the anti abuse task is running and templates load
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]CheckResult{}
+
+	if err := devices.Database.Session.Ping(); err != nil {
+		checks["store"] = CheckResult{Error: err.Error()}
+	} else {
+		checks["store"] = CheckResult{OK: true}
+	}
+
+	age := time.Since(time.Unix(0, atomic.LoadInt64(&lastTaskRun)))
+	if age > maxTaskAge {
+		checks["task"] = CheckResult{Error: "last ran " + age.Round(time.Second).String() + " ago"}
+	} else {
+		checks["task"] = CheckResult{OK: true}
+	}
+
+	checks["templates"] = CheckResult{OK: true}
+	for _, name := range requiredTemplates {
+		if _, err := view.GetTemplate(name); err != nil {
+			checks["templates"] = CheckResult{Error: err.Error()}
+			break
+		}
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	status := 200
+	if ready == false {
+		status = 503
+	}
+	writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+// /status: bot up or down and what the queue looks like
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	queue := map[string]int{}
+	for _, state := range queueStates {
+		c, err := devices.Find(state.Query).Count()
+		if err != nil {
+			logFrom(r.Context()).Error("counting queue", "state", state.Name, "err", err)
+			writeJSON(w, 503, map[string]string{"error": "store unavailable"})
+			return
+		}
+		queue[state.Name] = c
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"botUp":           botIsUp(),
+		"botLastSeen":     lastBotInteraction,
+		"minerCount":      minerCount(),
+		"idleMinerCount":  idleMinerCount(),
+		"connectionCount": connectionCount(),
+		"queue":           queue,
+	})
+}
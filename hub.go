@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// how long one write to a client may take
+	socketWriteWait = 10 * time.Second
+	// how long a client has to answer a ping before it is dropped
+	socketPongWait = 60 * time.Second
+	// must be shorter than socketPongWait
+	socketPingPeriod = socketPongWait * 9 / 10
+	// frames queued for a client before it is considered too slow and dropped
+	socketSendBuffer = 16
+)
+
+// biggest frame a client may send, a part1 submission is about 6KB
+var socketMaxMessageSize = int64(envInt("SEEDHELPER_SOCKET_MAX_MESSAGE", 16384))
+
+// ID0 to everything following it, websockets and event streams
+var connections = map[string]map[*watcher]bool{}
+var connectionsLock sync.Mutex
+
+// watcher : a queue of frames for one follower, it is closed rather than allowed to block
+// whoever is pushing to it
+type watcher struct {
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWatcher() *watcher {
+	return &watcher{
+		send: make(chan []byte, socketSendBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+// push queues a frame without blocking, a watcher whose queue is full is closed
+func (c *watcher) push(message []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *watcher) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// socketClient : one websocket, everything written to it goes through its watcher so that
+// a slow client only ever holds up its own write goroutine
+type socketClient struct {
+	*watcher
+	conn *websocket.Conn
+}
+
+func newSocketClient(conn *websocket.Conn) *socketClient {
+	conn.SetReadLimit(socketMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+	return &socketClient{watcher: newWatcher(), conn: conn}
+}
+
+// writeLoop sends queued frames and pings until the client is closed or a write fails,
+// closing the connection also ends the read loop
+func (c *socketClient) writeLoop() {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.close()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(socketWriteWait))
+			return
+		}
+	}
+}
+
+// watch sends updates about id0 to c
+func watch(id0 string, c *watcher) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	if connections[id0] == nil {
+		connections[id0] = map[*watcher]bool{}
+	}
+	connections[id0][c] = true
+}
+
+// removeConnection forgets every ID0 a watcher was following
+func removeConnection(c *watcher) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	for k, v := range connections {
+		delete(v, c)
+		if len(v) == 0 {
+			delete(connections, k)
+		}
+	}
+}
+
+// connectionCount is how many ID0s are being followed
+func connectionCount() int {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	return len(connections)
+}
+
+// notify tells everything following id0 that its status changed
+func notify(id0 string, status string) {
+	notifyReason(id0, status, "")
+}
+
+// notifyReason is notify with an explanation for the owner
+func notifyReason(id0 string, status string, reason string) {
+	connectionsLock.Lock()
+	var followers []*watcher
+	for c := range connections[id0] {
+		followers = append(followers, c)
+	}
+	connectionsLock.Unlock()
+	if len(followers) == 0 {
+		return
+	}
+	frame := statusMessage(status)
+	frame.Reason = reason
+	message := encodeMessage(frame)
+	for _, c := range followers {
+		if c.push(message) == false {
+			baseLog.Warn("dropped slow follower", "id0", id0)
+			removeConnection(c)
+		}
+	}
+}
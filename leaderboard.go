@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var jobEvents *mgo.Collection
+
+// JobEvent : a job a miner finished or let expire, the leaderboard is computed from these
+type JobEvent struct {
+	Miner     string `json:"-"`
+	Kind      string
+	Time      time.Time
+	Points    int
+	SolveTime float64 `bson:",omitempty"`
+}
+
+// LeaderboardRow : one miner's total within a leaderboard window
+type LeaderboardRow struct {
+	Rank      int
+	Name      string
+	Score     int
+	Completed int
+}
+
+const leaderboardPageSize = 25
+
+// how long a computed leaderboard page is served before it is worked out again
+var leaderboardCacheTime = envDuration("SEEDHELPER_LEADERBOARD_CACHE", time.Minute)
+
+// leaderboardEntry : a computed page and when it stops being served
+type leaderboardEntry struct {
+	rows    []LeaderboardRow
+	expires time.Time
+}
+
+var leaderboardCache = map[string]leaderboardEntry{}
+var leaderboardCacheLock sync.Mutex
+
+// windows a leaderboard can be computed over, 0 is all time
+var leaderboardWindows = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+	"all":  0,
+}
+
+// recordJobEvent stores a completion or expiry for the leaderboard and the miner's history
+func recordJobEvent(ip string, kind string, points int, solveTime time.Duration) {
+	if ip == "" {
+		return
+	}
+	err := jobEvents.Insert(JobEvent{Miner: ip, Kind: kind, Time: time.Now(), Points: points, SolveTime: solveTime.Seconds()})
+	if err != nil {
+		baseLog.Error("saving job event", "miner", ip, "err", err)
+	}
+}
+
+// leaderboardParams reads ?window=day|week|all and ?page=n, defaulting to all time and page 1
+func leaderboardParams(r *http.Request) (string, int) {
+	window := r.URL.Query().Get("window")
+	if _, ok := leaderboardWindows[window]; ok == false {
+		window = "all"
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return window, page
+}
+
+// windowStart is the earliest event time included in a window
+func windowStart(window string) time.Time {
+	if leaderboardWindows[window] == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-leaderboardWindows[window])
+}
+
+// leaderboard returns one page of miners ranked by points earned in the window,
+// miners are shown by their /setname name and never by IP
+func leaderboard(window string, page int) ([]LeaderboardRow, error) {
+	var totals []struct {
+		Miner     string `bson:"_id"`
+		Score     int
+		Completed int
+	}
+	err := jobEvents.Pipe([]bson.M{
+		{"$match": bson.M{"time": bson.M{"$gte": windowStart(window)}}},
+		{"$group": bson.M{
+			"_id":       "$miner",
+			"score":     bson.M{"$sum": "$points"},
+			"completed": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []string{"$kind", "completed"}}, 1, 0}}},
+		}},
+		{"$match": bson.M{"score": bson.M{"$gt": 0}}},
+		// _id breaks ties so pages don't overlap or skip rows, it has to be ordered so bson.D
+		{"$sort": bson.D{{Name: "score", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$skip": (page - 1) * leaderboardPageSize},
+		{"$limit": leaderboardPageSize},
+	}).All(&totals)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, len(totals))
+	for i, t := range totals {
+		ips[i] = t.Miner
+	}
+	var named []Miner
+	err = minerCollection.Find(bson.M{"_id": bson.M{"$in": ips}, "name": bson.M{"$exists": true}}).Select(bson.M{"name": 1}).All(&named)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, m := range named {
+		names[m.IP] = m.Name
+	}
+	rows := make([]LeaderboardRow, len(totals))
+	for i, t := range totals {
+		rows[i] = LeaderboardRow{Rank: (page-1)*leaderboardPageSize + i + 1, Name: names[t.Miner], Score: t.Score, Completed: t.Completed}
+		if rows[i].Name == "" {
+			rows[i].Name = "Someone"
+		}
+	}
+	return rows, nil
+}
+
+// cachedLeaderboard is leaderboard, computed at most once per SEEDHELPER_LEADERBOARD_CACHE for each
+// window and page. The home page's top 5 is the start of the all time page 1.
+func cachedLeaderboard(window string, page int) ([]LeaderboardRow, error) {
+	key := window + "/" + strconv.Itoa(page)
+	now := time.Now()
+	leaderboardCacheLock.Lock()
+	entry, ok := leaderboardCache[key]
+	leaderboardCacheLock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.rows, nil
+	}
+	rows, err := leaderboard(window, page)
+	if err != nil {
+		return nil, err
+	}
+	leaderboardCacheLock.Lock()
+	defer leaderboardCacheLock.Unlock()
+	for k, e := range leaderboardCache {
+		// pages nobody asks for again don't pile up
+		if now.After(e.expires) {
+			delete(leaderboardCache, k)
+		}
+	}
+	leaderboardCache[key] = leaderboardEntry{rows: rows, expires: now.Add(leaderboardCacheTime)}
+	return rows, nil
+}
+
+// MinerPage : what is shown about a miner on /miner/{name}
+type MinerPage struct {
+	Name    string
+	Score   int
+	Stats   MinerStats
+	Windows map[string]int // points per leaderboard window
+	History []JobEvent
+}
+
+// minerPage looks a miner up by their display name
+func minerPage(name string) (*MinerPage, error) {
+	var miner Miner
+	err := minerCollection.Find(bson.M{"namekey": nameKey(name)}).One(&miner)
+	if err != nil {
+		return nil, err
+	}
+	page := &MinerPage{Name: miner.Name, Score: miner.Score, Stats: miner.MinerStats, Windows: map[string]int{}}
+	page.Stats.SolveTimes = nil
+	err = jobEvents.Find(bson.M{"miner": miner.IP}).Sort("-time").Limit(50).All(&page.History)
+	if err != nil {
+		return nil, err
+	}
+	for window := range leaderboardWindows {
+		var sum []struct {
+			Points int
+		}
+		err = jobEvents.Pipe([]bson.M{
+			{"$match": bson.M{"miner": miner.IP, "time": bson.M{"$gte": windowStart(window)}}},
+			{"$group": bson.M{"_id": nil, "points": bson.M{"$sum": "$points"}}},
+		}).All(&sum)
+		if err != nil {
+			return nil, err
+		}
+		if len(sum) > 0 {
+			page.Windows[window] = sum[0].Points
+		}
+	}
+	// the same total the leaderboard ranks by
+	page.Score = page.Windows["all"]
+	return page, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Tomasen/realip"
+)
+
+// SEEDHELPER_LOG_FORMAT=json switches to JSON lines, SEEDHELPER_LOG_LEVEL picks debug/info/warn/error
+// and SEEDHELPER_LOG_REDACT=1 replaces ID0s, friend codes, LFCSes and every query value with a short hash
+var redactLogs = os.Getenv("SEEDHELPER_LOG_REDACT") == "1"
+
+var baseLog = newLogger()
+
+func newLogger() *slog.Logger {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("SEEDHELPER_LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	options := &slog.HandlerOptions{Level: level, AddSource: true, ReplaceAttr: redactAttr}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if os.Getenv("SEEDHELPER_LOG_FORMAT") == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	return slog.New(handler)
+}
+
+// attributes that identify a user's console
+var secretKeys = map[string]bool{"id0": true, "fc": true, "lfcs": true}
+
+// things in URLs that look like an ID0 or a friend code
+var secretPattern = regexp.MustCompile("[0-9a-fA-F]{32}|[0-9]{10,13}")
+
+// redact hashes a secret so log lines about the same console can still be matched up
+func redact(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "#" + hex.EncodeToString(sum[:4])
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactLogs == false {
+		return a
+	}
+	if secretKeys[a.Key] {
+		return slog.String(a.Key, redact(fmt.Sprint(a.Value.Any())))
+	}
+	if a.Key == "url" {
+		return slog.String(a.Key, redactURL(a.Value.String()))
+	}
+	return a
+}
+
+// redactURL hashes anything in the path that looks like a secret and every query value, which
+// can be an LFCS or anything else a client put there
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return secretPattern.ReplaceAllStringFunc(raw, redact)
+	}
+	u.Path = secretPattern.ReplaceAllStringFunc(u.Path, redact)
+	u.RawPath = ""
+	if u.RawQuery != "" {
+		q := u.Query()
+		for key, values := range q {
+			for i, v := range values {
+				values[i] = redact(v)
+			}
+			q[key] = values
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// query parameters that are never logged, not even hashed
+var secretParams = []string{"token"}
+
+// logURL is the request URL as it is logged, with secret query parameters stripped
+func logURL(u *url.URL) string {
+	q := u.Query()
+	stripped := false
+	for _, param := range secretParams {
+		if _, ok := q[param]; ok {
+			q.Del(param)
+			stripped = true
+		}
+	}
+	if stripped == false {
+		return u.String()
+	}
+	logged := *u
+	logged.RawQuery = q.Encode()
+	return logged.String()
+}
+
+type logKey struct{}
+
+// logFrom gets the request's logger, which carries its request ID
+func logFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(logKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return baseLog
+}
+
+// newRequestID makes a short random ID for a request or websocket session
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func logger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		l := baseLog.With("request_id", id, "ip", realip.FromRequest(r))
+		l.Info("request", "method", r.Method, "url", logURL(r.URL))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logKey{}, l)))
+	})
+}
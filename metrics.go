@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// counterVec : a prometheus counter with one label
+type counterVec struct {
+	sync.Mutex
+	Name   string
+	Help   string
+	Label  string
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{Name: name, Help: help, Label: label, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(label string) {
+	c.Lock()
+	c.values[label]++
+	c.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+	for _, label := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", c.Name, c.Label, label, c.values[label])
+	}
+}
+
+// histogram : bucket counts for one series, counts are not cumulative until written
+type histogram struct {
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+// histogramVec : a prometheus histogram with one label, or none if Label is empty
+type histogramVec struct {
+	sync.Mutex
+	Name    string
+	Help    string
+	Label   string
+	Buckets []float64
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{Name: name, Help: help, Label: label, Buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(label string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.series[label]
+	if ok == false {
+		s = &histogram{Counts: make([]uint64, len(h.Buckets))}
+		h.series[label] = s
+	}
+	for i, le := range h.Buckets {
+		if v <= le {
+			s.Counts[i]++
+			break
+		}
+	}
+	s.Sum += v
+	s.Count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+	labels := make([]string, 0, len(h.series))
+	for label := range h.series {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		s := h.series[label]
+		var cumulative uint64
+		for i, le := range h.Buckets {
+			cumulative += s.Counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, labelSet(h.Label, label, strconv.FormatFloat(le, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, labelSet(h.Label, label, "+Inf"), s.Count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.Name, labelSet(h.Label, label, ""), s.Sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, labelSet(h.Label, label, ""), s.Count)
+	}
+}
+
+// labelSet formats {name="value",le="bucket"}, leaving out whichever parts are empty
+func labelSet(name string, value string, le string) string {
+	var parts []string
+	if name != "" {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, value))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf("le=%q", le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// open websockets and event streams, counted by their handlers as they open and close
+var openSockets, openEventStreams int64
+
+var jobsMetric = newCounterVec("seedhelper_jobs_total", "Jobs claimed, completed and expired.", "event")
+var solveTimeMetric = newHistogramVec("seedhelper_solve_time_seconds", "Time from claim to upload of completed jobs.", "",
+	[]float64{60, 300, 600, 900, 1200, 1800, 2700, 3600, 5400})
+var httpLatencyMetric = newHistogramVec("seedhelper_http_request_duration_seconds", "HTTP request latency by route.", "route",
+	[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+
+// queueStates : the device states reported as queue depth, in the order they happen
+var queueStates = []struct {
+	Name  string
+	Query bson.M
+}{
+	{"waiting_for_bot", bson.M{"hasadded": false}},
+	{"waiting_for_friend", bson.M{"hasadded": true, "haspart1": false}},
+	{"has_part1", bson.M{"haspart1": true, "wantsbf": bson.M{"$ne": true}, "hasmovable": bson.M{"$ne": true}, "expired": bson.M{"$ne": true}}},
+	{"queued", bson.M{"haspart1": true, "wantsbf": true, "expirytime": time.Time{}, "expired": bson.M{"$ne": true}}},
+	{"mining", bson.M{"hasmovable": bson.M{"$ne": true}, "haspart1": true, "wantsbf": true, "expirytime": bson.M{"$ne": time.Time{}}, "expired": bson.M{"$ne": true}}},
+	{"done", bson.M{"hasmovable": true}},
+	{"flagged", bson.M{"expired": true}},
+}
+
+// instrument records the latency of every routed request
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		// websockets and event streams live as long as the tab is open so their latency means nothing
+		if route != "/socket" && route != "/events/{id0}" {
+			httpLatencyMetric.observe(route, time.Since(start).Seconds())
+		}
+	})
+}
+
+// writeGauge writes a single unlabelled gauge
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+}
+
+// serveMetrics writes everything in the prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP seedhelper_queue_depth Devices in each state.\n# TYPE seedhelper_queue_depth gauge\n")
+	for _, state := range queueStates {
+		c, err := devices.Find(state.Query).Count()
+		if err != nil {
+			logFrom(r.Context()).Error("counting queue", "state", state.Name, "err", err)
+			continue
+		}
+		fmt.Fprintf(w, "seedhelper_queue_depth{state=%q} %d\n", state.Name, c)
+	}
+	writeGauge(w, "seedhelper_active_miners", "Miners seen in the last 5 minutes.", float64(minerCount()))
+	writeGauge(w, "seedhelper_idle_miners", "Miners asking for work in the last 30 seconds.", float64(idleMinerCount()))
+	writeGauge(w, "seedhelper_websocket_connections", "Open websocket connections.", float64(atomic.LoadInt64(&openSockets)))
+	writeGauge(w, "seedhelper_event_streams", "Open server sent event streams.", float64(atomic.LoadInt64(&openEventStreams)))
+	writeGauge(w, "seedhelper_followed_id0s", "ID0s followed by a websocket or event stream.", float64(connectionCount()))
+	writeGauge(w, "seedhelper_bot_last_seen_seconds", "Seconds since the part1 bot last asked for friend codes.", time.Since(lastBotInteraction).Seconds())
+	jobsMetric.write(w)
+	solveTimeMetric.write(w)
+	httpLatencyMetric.write(w)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a movable.sed is a per-console secret, so it is only kept as long as the owner needs to fetch it.
+// SEEDHELPER_MOVABLE_RETENTION is how long after completion it is deleted,
+// SEEDHELPER_MOVABLE_TTL is how long after completion it can be downloaded (0 for as long as it is kept),
+// and SEEDHELPER_MOVABLE_ONE_TIME=1 deletes it as soon as it has been downloaded once.
+var movableRetention = envDuration("SEEDHELPER_MOVABLE_RETENTION", 7*24*time.Hour)
+var movableTTL = envDuration("SEEDHELPER_MOVABLE_TTL", 0)
+var movableOneTime = os.Getenv("SEEDHELPER_MOVABLE_ONE_TIME") == "1"
+
+// purgeMSed deletes a stored movable.sed, the device stays as a record that the job completed
+func purgeMSed(selector bson.M) (int, error) {
+	info, err := devices.UpdateAll(selector, bson.M{"$unset": bson.M{"msed": "", "msedsealed": ""}, "$set": bson.M{"msedpurged": true}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+// purgeOldMovables deletes every movable.sed older than the retention window, called from the retention task
+func purgeOldMovables() (int, error) {
+	return purgeMSed(bson.M{"hasmovable": true, "msedpurged": bson.M{"$ne": true}, "completedat": bson.M{"$lt": time.Now().Add(-movableRetention)}})
+}
+
+// backfillCompletedAt starts the retention clock for devices finished before it was recorded
+func backfillCompletedAt() {
+	info, err := devices.UpdateAll(bson.M{"hasmovable": true, "completedat": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"completedat": time.Now()}})
+	if err != nil {
+		baseLog.Error("backfilling completedat", "err", err)
+		return
+	}
+	if info.Updated > 0 {
+		baseLog.Info("backfilled completedat", "count", info.Updated)
+	}
+}
+
+// /movable/{id0}: the owner downloads their movable.sed with their session token in X-Seedhelper-Token.
+// It is never taken from the query string, where it would be logged and kept in browser history.
+func serveMovable(w http.ResponseWriter, r *http.Request) {
+	id0 := mux.Vars(r)["id0"]
+	l := logFrom(r.Context()).With("id0", id0)
+	var device Device
+	err := devices.Find(bson.M{"_id": id0}).One(&device)
+	if err == mgo.ErrNotFound {
+		l.Debug("movable for unknown device")
+		writeMinerError(w, r, notFound("no such device"))
+		return
+	} else if err != nil {
+		writeMinerError(w, r, storeError(err))
+		return
+	}
+	if device.HasMovable == false {
+		writeMinerError(w, r, notFound("movable not ready"))
+		return
+	}
+	if err := checkToken(device, r.Header.Get("X-Seedhelper-Token")); err != nil {
+		writeMinerError(w, r, err)
+		return
+	}
+	if device.MSedPurged || (movableTTL > 0 && time.Since(device.CompletedAt) > movableTTL) {
+		writeMinerError(w, r, gone("movable.sed has been deleted"))
+		return
+	}
+
+	msed, err := deviceMSed(device)
+	if err != nil {
+		writeMinerError(w, r, err)
+		return
+	}
+
+	selector := bson.M{"_id": id0, "msedpurged": bson.M{"$ne": true}}
+	if movableOneTime {
+		// whoever purges it first gets it, so two downloads can't race past the limit
+		if n, err := purgeMSed(selector); err != nil {
+			writeMinerError(w, r, storeError(err))
+			return
+		} else if n == 0 {
+			writeMinerError(w, r, gone("movable.sed has been deleted"))
+			return
+		}
+	} else {
+		devices.Update(selector, bson.M{"$inc": bson.M{"downloads": 1}})
+	}
+	l.Info("movable downloaded", "downloads", device.Downloads+1)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "inline; filename=\"movable.sed\"")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(msed[:])
+}
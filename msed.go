@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// msed_data contributions, one per device, used to improve msed3 estimates
+var msedData *mgo.Collection
+
+// hands out increasing sequence numbers so the export can be paged through incrementally
+var counters *mgo.Collection
+
+// version of the /mseds export, bump it if the record format changes
+const msedExportVersion = 1
+
+// biggest page the export will return
+const msedPageLimit = 1000
+
+// MsedRecord : one msed_data contribution. The 12 bytes seedminer uploads are
+// the LFCS, the real msed3 and the offset of the msed3 estimate, all little endian.
+type MsedRecord struct {
+	ID     string    `bson:"_id" json:"id0Hash"` // sha256 of the ID0
+	Seq    int64     `json:"seq"`
+	Data   []byte    `json:"data"` // the raw msed_data, base64 in JSON
+	LFCS   uint32    `json:"lfcs"`
+	MSed3  int32     `json:"msed3"`
+	Offset int32     `json:"offset"`
+	Miner  string    `json:"-"`
+	Time   time.Time `json:"time"`
+}
+
+func msedID(id0 string) string {
+	sum := sha256.Sum256([]byte(id0))
+	return hex.EncodeToString(sum[:])
+}
+
+func nextSeq(name string) (int64, error) {
+	var counter struct {
+		Seq int64
+	}
+	_, err := counters.Find(bson.M{"_id": name}).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"seq": 1}}, Upsert: true, ReturnNew: true}, &counter)
+	return counter.Seq, err
+}
+
+func newMsedRecord(id0 string, data []byte, miner string, t time.Time) MsedRecord {
+	return MsedRecord{
+		ID:     msedID(id0),
+		Data:   data,
+		LFCS:   binary.LittleEndian.Uint32(data[0:4]),
+		MSed3:  int32(binary.LittleEndian.Uint32(data[4:8])),
+		Offset: int32(binary.LittleEndian.Uint32(data[8:12])),
+		Miner:  miner,
+		Time:   t,
+	}
+}
+
+// saveMsedData stores a contribution, a device that already has one is left alone
+func saveMsedData(record MsedRecord) (bool, error) {
+	n, err := msedData.FindId(record.ID).Count()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return false, nil
+	}
+	record.Seq, err = nextSeq("mseds")
+	if err != nil {
+		return false, err
+	}
+	err = msedData.Insert(record)
+	if mgo.IsDup(err) {
+		// someone else uploaded the same device in between
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func ensureMsedIndex() {
+	for _, key := range []string{"seq", "lfcs", "time"} {
+		if err := msedData.EnsureIndex(mgo.Index{Key: []string{key}}); err != nil {
+			baseLog.Error("indexing mseds", "key", key, "err", err)
+		}
+	}
+}
+
+// where seedhelper used to publish msed_data files, under the static root
+const legacyMsedDir = "static/mseds/"
+
+// importLegacyMseds moves the msed_data files listed in static/mseds/list into the store. Everything
+// is served publicly from there and the file names are ID0s, so each file is deleted once it is in
+// the store and the list goes last.
+func importLegacyMseds() {
+	list := legacyMsedDir + "list"
+	f, err := os.Open(list)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		baseLog.Error("importing msed_data", "err", err)
+		return
+	}
+	n, kept := 0, 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		filename := strings.TrimSpace(scanner.Text())
+		id0 := strings.TrimSuffix(strings.TrimPrefix(filename, "msed_data_"), ".bin")
+		if validID0(id0) == false {
+			continue
+		}
+		data, err := ioutil.ReadFile(legacyMsedDir + filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil || len(data) != 12 {
+			baseLog.Warn("skipping msed_data", "file", filename, "err", err)
+			kept++
+			continue
+		}
+		t := time.Now()
+		if info, err := os.Stat(legacyMsedDir + filename); err == nil {
+			t = info.ModTime()
+		}
+		saved, err := saveMsedData(newMsedRecord(id0, data, "", t))
+		if err != nil {
+			baseLog.Error("importing msed_data", "file", filename, "err", err)
+			f.Close()
+			return
+		}
+		if saved {
+			n++
+		}
+		if err := os.Remove(legacyMsedDir + filename); err != nil {
+			baseLog.Error("deleting imported msed_data", "file", filename, "err", err)
+			kept++
+		}
+	}
+	f.Close()
+	if kept == 0 {
+		if err := os.Remove(list); err != nil {
+			baseLog.Error("deleting msed_data list", "err", err)
+		}
+	}
+	baseLog.Info("imported msed_data", "count", n, "kept", kept)
+}
+
+// removeLegacyMsed deletes id0's file from before the import, if it is still there
+func removeLegacyMsed(id0 string) error {
+	err := os.Remove(legacyMsedDir + "msed_data_" + id0 + ".bin")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// /mseds/v1?after=seq&limit=n: contributions in the order they arrived, pass the returned
+// next as after to get the following page
+func serveMseds(w http.ResponseWriter, r *http.Request) {
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > msedPageLimit {
+		limit = msedPageLimit
+	}
+	records := []MsedRecord{}
+	if err := msedData.Find(bson.M{"seq": bson.M{"$gt": after}}).Sort("seq").Limit(limit).All(&records); err != nil {
+		writeError(w, r, storeError(err))
+		return
+	}
+	next := after
+	if len(records) > 0 {
+		next = records[len(records)-1].Seq
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"version": msedExportVersion,
+		"records": records,
+		"next":    next,
+		"more":    len(records) == limit,
+	})
+}
+
+// how long the export gets to write each batch of records, the server's write timeout is too short for it
+const msedExportWriteWait = 30 * time.Second
+
+// msedExportQuery reads ?since=, either a unix timestamp or RFC 3339
+func msedExportQuery(r *http.Request) (bson.M, error) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return bson.M{}, nil
+	}
+	if unix, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return bson.M{"time": bson.M{"$gte": time.Unix(unix, 0)}}, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return nil, badRequest("since must be a unix timestamp or RFC 3339", err)
+	}
+	return bson.M{"time": bson.M{"$gte": t}}, nil
+}
+
+// msedExportETag changes whenever a record matching query is added or removed
+func msedExportETag(query bson.M, format string, since string) (string, error) {
+	count, err := msedData.Find(query).Count()
+	if err != nil {
+		return "", err
+	}
+	var last MsedRecord
+	err = msedData.Find(query).Sort("-seq").Select(bson.M{"seq": 1}).One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return "", err
+	}
+	return `"` + strings.Join([]string{"v" + strconv.Itoa(msedExportVersion), format, since, strconv.Itoa(count), strconv.FormatInt(last.Seq, 10)}, "-") + `"`, nil
+}
+
+// /mseds/v1/export?format=lfcs|lfcs_new|tar&since=t: every contribution in one download.
+// format=lfcs (the default) and lfcs_new are seedminer's lfcs.dat and lfcs_new.dat, 8 bytes per entry
+// of little endian LFCS and fine tune, sorted by LFCS. format=tar is a tarball of the raw
+// msed_data_<id0 hash>.bin files.
+func serveMsedExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "lfcs"
+	}
+	if format != "lfcs" && format != "lfcs_new" && format != "tar" {
+		writeError(w, r, badRequest("format must be lfcs, lfcs_new or tar", nil))
+		return
+	}
+	query, err := msedExportQuery(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// the new 3DS bit makes msed3 negative
+	if format == "lfcs" {
+		query["msed3"] = bson.M{"$gte": 0}
+	} else if format == "lfcs_new" {
+		query["msed3"] = bson.M{"$lt": 0}
+	}
+	etag, err := msedExportETag(query, format, r.URL.Query().Get("since"))
+	if err != nil {
+		writeError(w, r, storeError(err))
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	iter := msedData.Find(query).Sort("lfcs").Iter()
+	var record MsedRecord
+	var tw *tar.Writer
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"mseds.tar\"")
+		tw = tar.NewWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+format+".dat\"")
+	}
+	entry := make([]byte, 8)
+	n := 0
+	for iter.Next(&record) {
+		if n%1000 == 0 {
+			rc.SetWriteDeadline(time.Now().Add(msedExportWriteWait))
+		}
+		n++
+		if tw != nil {
+			err = tw.WriteHeader(&tar.Header{Name: "msed_data_" + record.ID + ".bin", Mode: 0644, Size: int64(len(record.Data)), ModTime: record.Time})
+			if err == nil {
+				_, err = tw.Write(record.Data)
+			}
+		} else {
+			binary.LittleEndian.PutUint32(entry[0:4], record.LFCS)
+			binary.LittleEndian.PutUint32(entry[4:8], uint32(record.fineTune()))
+			_, err = w.Write(entry)
+		}
+		if err != nil {
+			// the headers are gone so all that can be done is stop
+			logFrom(r.Context()).Debug("msed export aborted", "err", err)
+			iter.Close()
+			return
+		}
+	}
+	if err := iter.Close(); err != nil {
+		logFrom(r.Context()).Error("msed export", "err", err)
+		return
+	}
+	if tw != nil {
+		tw.Close()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const minNameLength = 3
+const maxNameLength = 24
+
+// confusables : characters that look like latin letters, folded together so "figgyc" and "f1ggyс" collide
+var confusables = strings.NewReplacer(
+	"0", "o", "1", "l", "i", "l", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b", "9", "g", "rn", "m", "vv", "w",
+	// cyrillic
+	"а", "a", "в", "b", "е", "e", "к", "k", "м", "m", "н", "h", "о", "o", "р", "p", "с", "c", "т", "t", "у", "y", "х", "x", "і", "l", "ј", "j", "ѕ", "s",
+	// greek
+	"α", "a", "β", "b", "ε", "e", "ι", "l", "κ", "k", "ν", "v", "ο", "o", "ρ", "p", "τ", "t", "υ", "u", "χ", "x",
+)
+
+// names nobody may take, as name keys; more can be added one per line in SEEDHELPER_NAME_BLOCKLIST
+var nameBlocklist = []string{nameKey("admin"), nameKey("seedhelper"), nameKey("figgyc"), nameKey("moderator")}
+
+// loadNameBlocklist adds the words in the configured blocklist file
+func loadNameBlocklist() {
+	path := os.Getenv("SEEDHELPER_NAME_BLOCKLIST")
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		baseLog.Error("opening name blocklist", "err", err)
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && strings.HasPrefix(word, "#") == false {
+			nameBlocklist = append(nameBlocklist, nameKey(word))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		baseLog.Error("reading name blocklist", "err", err)
+	}
+}
+
+// normaliseName tidies a display name up, returning an error if it breaks the name policy
+func normaliseName(name string) (string, error) {
+	if utf8.ValidString(name) == false {
+		return "", errors.New("name is not valid text")
+	}
+	name = strings.Join(strings.Fields(norm.NFKC.String(name)), " ")
+	if utf8.RuneCountInString(name) < minNameLength || utf8.RuneCountInString(name) > maxNameLength {
+		return "", errors.New("name must be between 3 and 24 characters")
+	}
+	for _, r := range name {
+		if unicode.IsLetter(r) == false && unicode.IsDigit(r) == false && strings.ContainsRune(" _-.", r) == false {
+			return "", errors.New("name can only contain letters, numbers, spaces and _-.")
+		}
+	}
+	key := nameKey(name)
+	if key == "" {
+		return "", errors.New("name must contain a letter or number")
+	}
+	for _, token := range append(nameTokens(name), key) {
+		for _, blocked := range nameBlocklist {
+			if blocked != "" && token == blocked {
+				return "", errors.New("name is not allowed")
+			}
+		}
+	}
+	return name, nil
+}
+
+// nameTokens is the name keys of each word in name, split at separators and where lower case runs
+// into upper case, so "SeedhelperAdmin" and "admin_bob" are caught but "badminton" isn't
+func nameTokens(name string) []string {
+	var tokens []string
+	var word []rune
+	flush := func() {
+		if key := nameKey(string(word)); key != "" {
+			tokens = append(tokens, key)
+		}
+		word = word[:0]
+	}
+	prev := ' '
+	for _, r := range name {
+		if strings.ContainsRune(" _-.", r) {
+			flush()
+		} else {
+			if unicode.IsUpper(r) && unicode.IsLower(prev) {
+				flush()
+			}
+			word = append(word, r)
+		}
+		prev = r
+	}
+	flush()
+	return tokens
+}
+
+// nameKey is what two names are compared by, case and look-alike insensitive
+func nameKey(name string) string {
+	key := cases.Fold().String(norm.NFKC.String(name))
+	key = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" _-.", r) {
+			return -1
+		}
+		return r
+	}, key)
+	return confusables.Replace(key)
+}
+
+// NameCollision : a name set before name keys existed that looks the same as one that was indexed first
+type NameCollision struct {
+	Name    string `json:"name"`
+	TakenBy string `json:"takenBy"`
+}
+
+// ensureNameIndex fills in name keys for names set before they existed and makes them unique.
+// Names that collide are left without a key, /admin/namecollisions lists them.
+func ensureNameIndex() {
+	var named []Miner
+	err := minerCollection.Find(bson.M{"name": bson.M{"$exists": true}, "namekey": bson.M{"$exists": false}}).All(&named)
+	if err != nil {
+		baseLog.Error("finding names", "err", err)
+	}
+	for _, miner := range named {
+		key := nameKey(miner.Name)
+		if c, _ := minerCollection.Find(bson.M{"namekey": key}).Count(); c > 0 {
+			baseLog.Warn("name collision, not indexed", "name", miner.Name)
+			continue
+		}
+		if err := minerCollection.UpdateId(miner.IP, bson.M{"$set": bson.M{"namekey": key}}); err != nil {
+			baseLog.Error("saving name key", "name", miner.Name, "err", err)
+		}
+	}
+	err = minerCollection.EnsureIndex(mgo.Index{Key: []string{"namekey"}, Unique: true, Sparse: true})
+	if err != nil {
+		baseLog.Error("creating name index", "err", err)
+	}
+}
+
+// /admin/namecollisions: names left unindexed by ensureNameIndex, resolve them with /admin/resetname
+func serveNameCollisions(w http.ResponseWriter, r *http.Request) {
+	var unindexed []Miner
+	err := minerCollection.Find(bson.M{"name": bson.M{"$exists": true}, "namekey": bson.M{"$exists": false}}).Select(bson.M{"name": 1}).All(&unindexed)
+	if err != nil {
+		writeError(w, r, storeError(err))
+		return
+	}
+	collisions := []NameCollision{}
+	for _, miner := range unindexed {
+		var holder Miner
+		if err := minerCollection.Find(bson.M{"namekey": nameKey(miner.Name)}).Select(bson.M{"name": 1}).One(&holder); err == nil {
+			collisions = append(collisions, NameCollision{Name: miner.Name, TakenBy: holder.Name})
+		}
+	}
+	writeJSON(w, 200, collisions)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNameKey(t *testing.T) {
+	for _, c := range []struct{ a, b string }{
+		{"FiggyC", "figgyc"},
+		{"f1ggyс", "figgyc"}, // digit one and cyrillic es
+		{"ｆｉｇｇｙｃ", "figgyc"},
+		{"ﬁggyc", "figgyc"},
+		{"Seed Helper", "seedhelper"},
+		{"seed_helper.", "seedhelper"},
+		{"barn", "bam"},
+		{"vvolf", "wolf"},
+		{"κοτα", "kota"}, // greek
+	} {
+		if a, b := nameKey(c.a), nameKey(c.b); a != b {
+			t.Errorf("nameKey(%q) = %q, nameKey(%q) = %q", c.a, a, c.b, b)
+		}
+	}
+	for _, c := range []struct{ a, b string }{
+		{"alice", "bob"},
+		{"figgyc", "figgy"},
+	} {
+		if nameKey(c.a) == nameKey(c.b) {
+			t.Errorf("%q and %q share the key %q", c.a, c.b, nameKey(c.a))
+		}
+	}
+}
+
+func TestNameTokens(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tokens []string
+	}{
+		{"SeedhelperAdmin", []string{nameKey("seedhelper"), nameKey("admin")}},
+		{"admin_bob", []string{nameKey("admin"), nameKey("bob")}},
+		{"badminton", []string{nameKey("badminton")}},
+		{"x.y-z w", []string{"x", "y", "z", "w"}},
+		{"ABC", []string{"abc"}},
+		{"fooBAR", []string{"foo", "bar"}},
+		{"__", nil},
+	} {
+		if got := nameTokens(c.name); reflect.DeepEqual(got, c.tokens) == false {
+			t.Errorf("nameTokens(%q) = %q, want %q", c.name, got, c.tokens)
+		}
+	}
+}
+
+func TestNormaliseName(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want string // empty if it is refused
+	}{
+		{"  alice   smith ", "alice smith"},
+		{"ｂｏｂ", "bob"},
+		{"badminton", "badminton"},
+		{"Mr.Admin-Fan", ""},
+		{"ab", ""},
+		{strings.Repeat("a", maxNameLength+1), ""},
+		{"bob!", ""},
+		{"___", ""},
+		{"\xff\xfe\xfd", ""},
+		{"admin", ""},
+		{"ＡＤＭＩＮ", ""},
+		{"admin_bob", ""},
+		{"SeedhelperAdmin", ""},
+		{"Seed Helper", ""},
+		{"f1ggyс", ""},
+		{"ﬁggyc", ""},
+	} {
+		got, err := normaliseName(c.name)
+		if c.want == "" && err == nil {
+			t.Errorf("normaliseName(%q) = %q, want it refused", c.name, got)
+		} else if c.want != "" && (err != nil || got != c.want) {
+			t.Errorf("normaliseName(%q) = %q, %v, want %q", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestNameBlocklistFile(t *testing.T) {
+	saved := nameBlocklist
+	defer func() { nameBlocklist = saved }()
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("# staff\n\nMallory\n  eve  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SEEDHELPER_NAME_BLOCKLIST", path)
+	loadNameBlocklist()
+	for _, c := range []struct {
+		name    string
+		allowed bool
+	}{
+		{"mallory", false},
+		{"MaIIory", false},
+		{"eve_fan", false},
+		{"steve", true},
+		{"mallory2", true},
+		{"# staff", false}, // not a name anyway
+		{"staff", true},
+	} {
+		if _, err := normaliseName(c.name); (err == nil) != c.allowed {
+			t.Errorf("normaliseName(%q) allowed %v, want %v", c.name, err == nil, c.allowed)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// The websocket protocol. Every frame is a JSON object with a "type".
+//
+// Client to server:
+//
+//	hello       {"type":"hello","version":1}, optional, answered with a hello carrying the server's version
+//	identify    {"type":"identify","id0":...}, answered with the device's status
+//	friendCode  {"type":"friendCode","id0":...,"friendCode":...,"defoID0":"yes"|"no","token":...}
+//	part1       {"type":"part1","id0":...,"part1":base64,"defoID0":"yes"|"no","token":...}
+//	bruteforce  {"type":"bruteforce","id0":...,"token":...}
+//	cancel      {"type":"cancel","id0":...,"token":...}
+//	recover     {"type":"recover","id0":...,"code":...}, answered with a session frame
+//	delete      {"type":"delete","id0":...,"token":...}, deletes everything stored about the device
+//
+// Server to client:
+//
+//	hello       {"type":"hello","version":1}
+//	status      {"type":"status","status":...,"minerCount":...,...stats}
+//	session     {"type":"session","token":...}
+//	error       {"type":"error","status":"error","reason":...}, the connection stays open
+//
+// Frames without a type are from clients older than the typed protocol and have their type
+// inferred from which keys are set. Unknown types get an error frame.
+//
+// Submitting a device starts a session, the status frame answering it carries a "token" and a
+// "recoveryCode". The token is needed to cancel, requeue, resubmit or download the movable.sed,
+// the recovery code gets a new token if it is lost. Clients that send no hello at all are served
+// the same and need the same tokens.
+const protocolVersion = 1
+
+// client message types
+const (
+	msgHello      = "hello"
+	msgIdentify   = "identify"
+	msgFriendCode = "friendCode"
+	msgPart1      = "part1"
+	msgBruteforce = "bruteforce"
+	msgCancel     = "cancel"
+	msgRecover    = "recover"
+	msgDelete     = "delete"
+)
+
+// server message types
+const (
+	msgStatus  = "status"
+	msgSession = "session"
+	msgError   = "error"
+)
+
+// ClientMessage : a frame from a websocket client, fields are pointers where legacy inference needs to know if they were sent
+type ClientMessage struct {
+	Type       string  `json:"type"`
+	Version    int     `json:"version,omitempty"`
+	ID0        string  `json:"id0"`
+	FriendCode *string `json:"friendCode"`
+	Part1      *string `json:"part1"`
+	DefoID0    string  `json:"defoID0"`
+	Token      string  `json:"token"`
+	Code       string  `json:"code"`
+	// before the typed protocol bruteforce and cancel were sent as {"request":...}
+	Request string `json:"request"`
+}
+
+// ServerMessage : a frame to a websocket client
+type ServerMessage struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// only sent once, when a session starts or is recovered
+	Token        string `json:"token,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+	// only status frames carry stats
+	*SiteStats
+}
+
+// SiteStats : the counters shown at the top of the page
+type SiteStats struct {
+	MinerCount  int `json:"minerCount"`
+	UserCount   int `json:"userCount"`
+	MiningCount int `json:"miningCount"`
+	P1Count     int `json:"p1Count"`
+	MSCount     int `json:"msCount"`
+	TotalCount  int `json:"totalCount"`
+}
+
+// parseClientMessage decodes a frame and works out its type
+func parseClientMessage(p []byte) (ClientMessage, error) {
+	var message ClientMessage
+	if err := json.Unmarshal(p, &message); err != nil {
+		return message, badRequest("message is not valid JSON", err)
+	}
+	if message.Type == "" {
+		message.Type = legacyType(message)
+		if message.Type == "" {
+			return message, badRequest("unknown request "+strconv.Quote(message.Request), nil)
+		}
+		return message, nil
+	}
+	switch message.Type {
+	case msgHello, msgIdentify, msgFriendCode, msgPart1, msgBruteforce, msgCancel, msgRecover, msgDelete:
+	default:
+		return message, badRequest("unknown message type "+strconv.Quote(message.Type), nil)
+	}
+	if message.Type != msgHello && message.ID0 == "" {
+		return message, badRequest("id0 is required", nil)
+	}
+	if message.Type == msgFriendCode && message.FriendCode == nil {
+		return message, badRequest("friendCode is required", nil)
+	}
+	if message.Type == msgPart1 && message.Part1 == nil {
+		return message, badRequest("part1 is required", nil)
+	}
+	if message.Type == msgRecover && message.Code == "" {
+		return message, badRequest("code is required", nil)
+	}
+	return message, nil
+}
+
+// legacyType is the type an untyped frame would have been treated as before the typed protocol
+func legacyType(message ClientMessage) string {
+	switch {
+	case message.Request == "bruteforce":
+		return msgBruteforce
+	case message.Request == "cancel":
+		return msgCancel
+	case message.Request != "":
+		return ""
+	case message.Part1 != nil:
+		return msgPart1
+	case message.FriendCode != nil:
+		return msgFriendCode
+	}
+	return msgIdentify
+}
+
+func encodeMessage(message ServerMessage) []byte {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return []byte("{}")
+	}
+	return data
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Tomasen/realip"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A job can be split into ranges of msed3 offsets so several miners search one device at once.
+// Range i covers the offsets whose distance from the estimate is at least i*SEEDHELPER_RANGE_SIZE and
+// less than (i+1)*SEEDHELPER_RANGE_SIZE past where earlier attempts got to, in both directions, which
+// is the order bfcl searches them in.
+// Jobs are split when a miner asks /getrange and there is a queued job, or a whole job has been
+// mining for longer than SEEDHELPER_RANGE_SPLIT_AFTER. The ranges only exist while the job is being
+// mined, the first upload deletes them so the other miners get "error" from /check.
+var jobRanges *mgo.Collection
+
+var rangeCount = envInt("SEEDHELPER_RANGE_COUNT", 4)
+var rangeSize = envInt("SEEDHELPER_RANGE_SIZE", 256)
+var rangeSplitAfter = envDuration("SEEDHELPER_RANGE_SPLIT_AFTER", 5*time.Minute)
+
+// range states
+const (
+	rangeOpen     = "open"
+	rangeMining   = "mining"
+	rangeSearched = "searched"
+)
+
+// JobRange : one miner's share of a split job
+type JobRange struct {
+	ID    string `bson:"_id"` // id0/index
+	ID0   string
+	Index int
+	// distances from the msed3 estimate, Start inclusive and End exclusive
+	Start int
+	End   int
+	// how far the miner has got, from /check?offset=, so a requeued range doesn't start over
+	Progress   int
+	State      string
+	Miner      string
+	ClaimedAt  time.Time
+	CheckTime  time.Time
+	ExpiryTime time.Time
+	Failures   int
+}
+
+// resumeFrom is where the next miner on this range should start
+func (jobRange JobRange) resumeFrom() int {
+	if jobRange.Progress > jobRange.Start && jobRange.Progress < jobRange.End {
+		return jobRange.Progress
+	}
+	return jobRange.Start
+}
+
+func ensureRangeIndex() {
+	for _, key := range [][]string{{"id0"}, {"state", "index"}, {"miner"}} {
+		if err := jobRanges.EnsureIndexKey(key...); err != nil {
+			baseLog.Error("indexing ranges", "key", key, "err", err)
+		}
+	}
+}
+
+// queuedWork is the query for jobs waiting for a miner, jobs that have already failed go to dependable miners
+// first and never back to a miner that has already tried them
+func queuedWork(ip string) bson.M {
+	work := bson.M{"haspart1": true, "wantsbf": true, "expirytime": bson.M{"$eq": time.Time{}}, "expired": bson.M{"$ne": true}, "attempts.miner": bson.M{"$ne": ip}}
+	if isReliable(ip) == false {
+		work["failures"] = bson.M{"$not": bson.M{"$gt": 0}}
+	}
+	return work
+}
+
+// minerBusy is whether ip already holds a whole job or a range
+func minerBusy(ip string) bool {
+	n, err := devices.Find(bson.M{"miner": ip, "hasmovable": bson.M{"$ne": true}, "expirytime": bson.M{"$ne": time.Time{}}, "expired": bson.M{"$ne": true}}).Count()
+	if err != nil || n > 0 {
+		return true
+	}
+	n, err = jobRanges.Find(bson.M{"miner": ip, "state": rangeMining}).Count()
+	return err != nil || n > 0
+}
+
+func isSplit(id0 string) bool {
+	n, err := devices.Find(bson.M{"_id": id0, "split": true}).Count()
+	return err == nil && n > 0
+}
+
+// insertRanges splits id0 up, starting from where earlier attempts got to. If miner was already
+// mining the whole job it keeps the first range, which is where it is searching anyway.
+func insertRanges(id0 string, from int, miner string, claimedAt time.Time, expiry time.Time) error {
+	if err := clearRanges(id0); err != nil {
+		return err
+	}
+	ranges := make([]interface{}, 0, rangeCount)
+	for i := 0; i < rangeCount; i++ {
+		jobRange := JobRange{ID: id0 + "/" + strconv.Itoa(i), ID0: id0, Index: i, Start: from + i*rangeSize, End: from + (i+1)*rangeSize, State: rangeOpen}
+		if i == 0 && miner != "" {
+			jobRange.State, jobRange.Miner, jobRange.ClaimedAt = rangeMining, miner, claimedAt
+			jobRange.CheckTime, jobRange.ExpiryTime = time.Now().Add(time.Minute), expiry
+		}
+		ranges = append(ranges, jobRange)
+	}
+	return jobRanges.Insert(ranges...)
+}
+
+// clearRanges deletes a job's ranges, when it is solved, flagged or resubmitted
+func clearRanges(id0 string) error {
+	_, err := jobRanges.RemoveAll(bson.M{"id0": id0})
+	return err
+}
+
+// splitQueuedJob splits the job /getwork would hand out next
+func splitQueuedJob(work bson.M) error {
+	var device Device
+	_, err := devices.Find(work).Sort("-failures").Apply(mgo.Change{Update: bson.M{"$set": bson.M{"split": true, "miner": "", "expirytime": time.Now().Add(time.Hour), "claimedat": time.Now()}}}, &device)
+	if err != nil {
+		return err
+	}
+	return insertRanges(device.ID0, device.SearchedTo, "", time.Time{}, time.Time{})
+}
+
+// splitRunningJob splits the job that has been mined whole for longest, if it has been long enough.
+// Only jobs held by a miner that declared ranges=1 are split, anything else would keep searching
+// the whole job and never hear that it now has a range.
+func splitRunningJob() error {
+	var holders []string
+	err := minerCollection.Find(bson.M{"_id": bson.M{"$in": activeMiners()}, "capabilities.ranges": true}).Distinct("_id", &holders)
+	if err != nil {
+		return err
+	}
+	if len(holders) == 0 {
+		return mgo.ErrNotFound
+	}
+	var device Device
+	query := devices.Find(bson.M{"miner": bson.M{"$in": holders}, "wantsbf": true, "hasmovable": bson.M{"$ne": true}, "expired": bson.M{"$ne": true}, "split": bson.M{"$ne": true}, "expirytime": bson.M{"$gt": time.Now()}, "claimedat": bson.M{"$lt": time.Now().Add(-rangeSplitAfter)}})
+	// the old document, so the miner that had it whole is known
+	_, err = query.Sort("claimedat").Apply(mgo.Change{Update: bson.M{"$set": bson.M{"split": true, "miner": ""}}}, &device)
+	if err != nil {
+		return err
+	}
+	return insertRanges(device.ID0, device.SearchedTo, device.Miner, device.ClaimedAt, device.ExpiryTime)
+}
+
+func claimRange(ip string, maxJobTime time.Duration) (JobRange, error) {
+	var jobRange JobRange
+	now := time.Now()
+	_, err := jobRanges.Find(bson.M{"state": rangeOpen}).Sort("index", "id0").Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"state": rangeMining, "miner": ip, "claimedat": now, "checktime": now.Add(time.Minute), "expirytime": now.Add(maxJobTime)}},
+		ReturnNew: true,
+	}, &jobRange)
+	return jobRange, err
+}
+
+// widenRange merges up to extra open ranges that carry on from jobRange into it, for fast miners
+func widenRange(jobRange JobRange, extra int) (JobRange, error) {
+	end := jobRange.End
+	for i := 0; i < extra; i++ {
+		var next JobRange
+		_, err := jobRanges.Find(bson.M{"id0": jobRange.ID0, "state": rangeOpen, "start": end}).Apply(mgo.Change{Remove: true}, &next)
+		if err == mgo.ErrNotFound {
+			break
+		} else if err != nil {
+			return jobRange, err
+		}
+		end = next.End
+	}
+	if end == jobRange.End {
+		return jobRange, nil
+	}
+	if err := jobRanges.UpdateId(jobRange.ID, bson.M{"$set": bson.M{"end": end}}); err != nil {
+		return jobRange, err
+	}
+	jobRange.End = end
+	return jobRange, nil
+}
+
+// checkRange is /check for a split job. index is empty for a miner that had the whole job before it was split,
+// it is told which range it kept.
+func checkRange(id0 string, ip string, index string, progress string) (JobRange, bool) {
+	var jobRange JobRange
+	selector := bson.M{"id0": id0, "miner": ip, "state": rangeMining}
+	if index != "" {
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return jobRange, false
+		}
+		selector["index"] = i
+	}
+	update := bson.M{"$set": bson.M{"checktime": time.Now().Add(time.Minute)}}
+	if offset, err := strconv.Atoi(progress); err == nil {
+		update["$max"] = bson.M{"progress": offset}
+	}
+	_, err := jobRanges.Find(selector).Apply(mgo.Change{Update: update, ReturnNew: true}, &jobRange)
+	return jobRange, err == nil
+}
+
+// rangeSolveTime is how long ip had its range of id0 for, 0 if it had none
+func rangeSolveTime(id0 string, ip string) time.Duration {
+	var jobRange JobRange
+	if err := jobRanges.Find(bson.M{"id0": id0, "miner": ip, "state": rangeMining}).One(&jobRange); err != nil {
+		return 0
+	}
+	return time.Since(jobRange.ClaimedAt)
+}
+
+// cancelRange is /cancel for a split job. searched means the miner got through its range without
+// finding anything, otherwise the range is put back for someone else from where the miner got to.
+// It reports whether every range has now been searched.
+func cancelRange(id0 string, ip string, index string, searched bool) (bool, error) {
+	selector := bson.M{"id0": id0, "miner": ip, "state": rangeMining}
+	if index != "" {
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return false, badRequest("range must be a number", err)
+		}
+		selector["index"] = i
+	}
+	var jobRange JobRange
+	err := jobRanges.Find(selector).One(&jobRange)
+	if err == nil {
+		update := bson.M{"$set": bson.M{"state": rangeOpen, "miner": "", "start": jobRange.resumeFrom()}}
+		if searched {
+			update = bson.M{"$set": bson.M{"state": rangeSearched}}
+		}
+		err = jobRanges.Update(bson.M{"_id": jobRange.ID, "state": rangeMining, "miner": ip}, update)
+	}
+	if err == mgo.ErrNotFound {
+		return false, notFound("no such range")
+	} else if err != nil {
+		return false, storeError(err)
+	}
+	left, err := jobRanges.Find(bson.M{"id0": id0, "state": bson.M{"$ne": rangeSearched}}).Count()
+	if err != nil {
+		return false, storeError(err)
+	}
+	return left == 0, nil
+}
+
+// expireRanges puts ranges whose miner stopped checking back up for grabs from where it got to,
+// called from the anti abuse task
+func expireRanges() {
+	var stale []JobRange
+	now := time.Now()
+	err := jobRanges.Find(bson.M{"state": rangeMining, "$or": []bson.M{{"checktime": bson.M{"$lt": now}}, {"expirytime": bson.M{"$lt": now}}}}).All(&stale)
+	if err != nil {
+		baseLog.Error("finding expired ranges", "err", err)
+		return
+	}
+	for _, jobRange := range stale {
+		l := baseLog.With("id0", jobRange.ID0, "range", jobRange.Index, "miner", jobRange.Miner)
+		start := jobRange.resumeFrom()
+		err := jobRanges.Update(bson.M{"_id": jobRange.ID, "state": rangeMining, "miner": jobRange.Miner}, bson.M{"$set": bson.M{"state": rangeOpen, "miner": "", "start": start}, "$inc": bson.M{"failures": 1}})
+		if err != nil && err != mgo.ErrNotFound {
+			l.Error("requeueing range", "err", err)
+			continue
+		}
+		statsExpired(jobRange.Miner)
+		l.Info("range has checktimed, requeued", "start", start)
+	}
+}
+
+// collapseIdleSplits turns split jobs that nobody has mined for SEEDHELPER_RANGE_SPLIT_AFTER back into
+// one queued job, starting from the nearest range that is still open, so /getwork miners finish
+// them when the /getrange miners have gone. Called from the anti abuse task after expireRanges.
+func collapseIdleSplits() {
+	var split []Device
+	err := devices.Find(bson.M{"split": true, "wantsbf": true, "hasmovable": bson.M{"$ne": true}, "expired": bson.M{"$ne": true}}).Select(bson.M{"_id": 1, "claimedat": 1, "searchedto": 1}).All(&split)
+	if err != nil {
+		baseLog.Error("finding split jobs", "err", err)
+		return
+	}
+	for _, device := range split {
+		l := baseLog.With("id0", device.ID0)
+		var ranges []JobRange
+		if err := jobRanges.Find(bson.M{"id0": device.ID0}).All(&ranges); err != nil {
+			l.Error("finding ranges", "err", err)
+			continue
+		}
+		lastActive, from, mining := device.ClaimedAt, -1, false
+		for _, jobRange := range ranges {
+			if jobRange.State == rangeMining {
+				mining = true
+			}
+			for _, t := range []time.Time{jobRange.ClaimedAt, jobRange.CheckTime} {
+				if t.After(lastActive) {
+					lastActive = t
+				}
+			}
+			if jobRange.State == rangeOpen && (from < 0 || jobRange.resumeFrom() < from) {
+				from = jobRange.resumeFrom()
+			}
+		}
+		if mining || time.Since(lastActive) < rangeSplitAfter {
+			continue
+		}
+		if from < 0 {
+			from = device.SearchedTo
+		}
+		err := devices.Update(bson.M{"_id": device.ID0, "split": true}, bson.M{"$set": bson.M{"split": false, "expirytime": time.Time{}, "miner": "", "searchedto": from}})
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			l.Error("collapsing split job", "err", err)
+			continue
+		}
+		if err := clearRanges(device.ID0); err != nil {
+			l.Error("clearing ranges", "err", err)
+		}
+		notify(device.ID0, "queue")
+		l.Info("idle split job requeued whole", "searchedto", from)
+	}
+}
+
+// /getrange: /getwork and /claim in one for miners that can search part of a job. The answer is
+// "nothing" or "<id0> <range> <start> <end>": search the msed3 offsets at least start and less than
+// end away from /part1's estimate, send range=<range> with /check and /cancel, and upload as usual.
+func serveGetRange(w http.ResponseWriter, r *http.Request) {
+	l := logFrom(r.Context())
+	ip := realip.FromRequest(r)
+	sawMiner(ip, true)
+	caps, ok := negotiate(w, r)
+	if ok == false {
+		return
+	}
+	if abuse.isThrottled(ip) || rangeCount < 2 {
+		w.Write([]byte("nothing"))
+		return
+	}
+	if hashrate, err := strconv.ParseFloat(r.URL.Query().Get("hashrate"), 64); err == nil {
+		statsHashrate(ip, hashrate)
+	}
+	if minerBusy(ip) {
+		w.Write([]byte("nothing"))
+		return
+	}
+	jobRange, err := claimRange(ip, caps.maxJobTime())
+	if err == mgo.ErrNotFound {
+		err = splitQueuedJob(queuedWork(ip))
+		if err == mgo.ErrNotFound {
+			err = splitRunningJob()
+		}
+		if err == nil {
+			jobRange, err = claimRange(ip, caps.maxJobTime())
+		}
+	}
+	if n := rangesFor(ip, caps); err == nil && n > 1 {
+		// fast miners get the ranges after theirs as well
+		jobRange, err = widenRange(jobRange, n-1)
+	}
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			l.Error("finding a range", "err", err)
+		}
+		w.Write([]byte("nothing"))
+		return
+	}
+	jobsMetric.inc("range_claimed")
+	l.Info("range claimed", "id0", jobRange.ID0, "range", jobRange.Index)
+	notify(jobRange.ID0, "bruteforcing")
+	fmt.Fprintf(w, "%s %d %d %d", jobRange.ID0, jobRange.Index, jobRange.Start, jobRange.End)
+}
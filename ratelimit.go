@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tomasen/realip"
+)
+
+// bucket : token bucket for one client
+type bucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// rateLimiter : token buckets keyed by miner identity or IP
+type rateLimiter struct {
+	sync.Mutex
+	Name    string
+	Rate    float64 // tokens per second
+	Burst   float64
+	buckets map[string]*bucket
+}
+
+// newRateLimiter makes a limiter, rate and burst can be overridden with SEEDHELPER_RATELIMIT_<NAME>=rate,burst
+func newRateLimiter(name string, rate float64, burst float64) *rateLimiter {
+	env := os.Getenv("SEEDHELPER_RATELIMIT_" + strings.ToUpper(name))
+	if env != "" {
+		parts := strings.Split(env, ",")
+		r, err := strconv.ParseFloat(parts[0], 64)
+		if err == nil && r > 0 {
+			rate = r
+		} else {
+			baseLog.Warn("bad rate limit", "name", name, "value", env)
+		}
+		if len(parts) > 1 {
+			b, err := strconv.ParseFloat(parts[1], 64)
+			if err == nil && b >= 1 {
+				burst = b
+			} else {
+				baseLog.Warn("bad rate limit", "name", name, "value", env)
+			}
+		}
+	}
+	return &rateLimiter{Name: name, Rate: rate, Burst: burst, buckets: map[string]*bucket{}}
+}
+
+// allow takes a token for key, if there isn't one it returns how long until there will be
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	if ok == false {
+		b = &bucket{Tokens: l.Burst, Last: now}
+		l.buckets[key] = b
+	}
+	b.Tokens = math.Min(l.Burst, b.Tokens+now.Sub(b.Last).Seconds()*l.Rate)
+	b.Last = now
+	if b.Tokens < 1 {
+		return false, time.Duration((1 - b.Tokens) / l.Rate * float64(time.Second))
+	}
+	b.Tokens--
+	return true, 0
+}
+
+// cleanup forgets clients whose buckets have refilled, called from the anti abuse task
+func (l *rateLimiter) cleanup() {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	for key, b := range l.buckets {
+		if b.Tokens+now.Sub(b.Last).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// separate budgets so a flood on one kind of endpoint doesn't starve the others
+var socketLimiter = newRateLimiter("socket", 1, 20)
+var minerLimiter = newRateLimiter("miner", 2, 40)
+var botLimiter = newRateLimiter("bot", 5, 100)
+var downloadLimiter = newRateLimiter("download", 0.2, 10)
+var pageLimiter = newRateLimiter("pages", 1, 20)
+
+var limiters = []*rateLimiter{socketLimiter, minerLimiter, botLimiter, downloadLimiter, pageLimiter}
+
+// limiterFor picks the budget for a request path, nil means unlimited
+func limiterFor(path string) *rateLimiter {
+	switch strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0] {
+	case "socket", "events", "status":
+		return socketLimiter
+	case "getwork", "getrange", "claim", "part1", "check", "cancel", "release", "abandon", "upload", "setname":
+		return minerLimiter
+	case "getfcs", "added", "lfcs", "mseds":
+		return botLimiter
+	case "movable":
+		return downloadLimiter
+	case "leaderboard", "leaderboard.json", "miner":
+		// these pages add up the job events
+		return pageLimiter
+	}
+	return nil
+}
+
+// what a rate limited miner is told instead of "slow down", because the autolaunchers act on the body
+// whatever the status: /getwork's is taken as an ID0 and /claim is only refused by "error". A limited
+// /check isn't an ok, the job's checktime wasn't moved on, so it gets "wait", which the autolaunchers
+// take as carry on mining and check again later.
+var limitedBodies = map[string]string{"getwork": "nothing", "getrange": "nothing", "claim": "error", "check": "wait"}
+
+// limitedBody is the body of a 429 for path
+func limitedBody(path string) string {
+	if body, ok := limitedBodies[strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]]; ok {
+		return body
+	}
+	return "slow down"
+}
+
+// retryAfter formats a wait as whole seconds for the Retry-After header
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := limiterFor(r.URL.Path)
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := limiter.allow(realip.FromRequest(r))
+		if ok == false {
+			logFrom(r.Context()).Warn("rate limited", "limiter", limiter.Name)
+			w.Header().Set("Retry-After", retryAfter(wait))
+			w.WriteHeader(429)
+			w.Write([]byte(limitedBody(r.URL.Path)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// how long finished devices keep their personal data, SEEDHELPER_RETAIN_DEVICES covers
+// completed and flagged devices and SEEDHELPER_RETAIN_CANCELLED cancelled ones, which are deleted outright.
+// Miners with no job events inside SEEDHELPER_RETAIN_MINERS are forgotten unless they are banned,
+// and job events older than that are deleted.
+var retainDevices = envDuration("SEEDHELPER_RETAIN_DEVICES", 30*24*time.Hour)
+var retainCancelled = envDuration("SEEDHELPER_RETAIN_CANCELLED", 7*24*time.Hour)
+var retainMiners = envDuration("SEEDHELPER_RETAIN_MINERS", 180*24*time.Hour)
+
+// the retention task is cheap to skip, it runs from the anti abuse task at most this often
+const retentionInterval = time.Hour
+
+var lastRetentionRun time.Time
+
+// what a purge run or a user deletion did, kept for /admin/purges
+var purgeLog *mgo.Collection
+
+// PurgeReport : what one retention run or user deletion removed
+type PurgeReport struct {
+	Time              time.Time
+	Kind              string   // "retention" or "user"
+	MovablesPurged    int      `bson:",omitempty" json:",omitempty"`
+	DevicesAnonymised int      `bson:",omitempty" json:",omitempty"`
+	MsedsAnonymised   int      `bson:",omitempty" json:",omitempty"`
+	DevicesDeleted    int      `bson:",omitempty" json:",omitempty"`
+	MinersDeleted     int      `bson:",omitempty" json:",omitempty"`
+	EventsDeleted     int      `bson:",omitempty" json:",omitempty"`
+	Errors            []string `bson:",omitempty" json:",omitempty"`
+}
+
+func (p PurgeReport) empty() bool {
+	return p.MovablesPurged+p.DevicesAnonymised+p.MsedsAnonymised+p.DevicesDeleted+p.MinersDeleted+p.EventsDeleted == 0 && len(p.Errors) == 0
+}
+
+// personal fields removed when a device is anonymised, what is left is enough for the site stats
+// and, with the ID0 replaced by anonymousID, for a flagged ID0 to stay flagged
+var personalFields = bson.M{"friendcode": "", "lfcs": "", "msed": "", "lfcssealed": "", "msedsealed": "", "msdata": "", "submitter": "", "miner": "", "tokenhash": "", "recoveryhash": "", "attempts": ""}
+
+// backfillRetentionTimes starts the retention clock for devices that were flagged or cancelled before it was recorded
+func backfillRetentionTimes() {
+	_, err := devices.UpdateAll(bson.M{"expired": true, "flaggedat": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"flaggedat": time.Now()}})
+	if err != nil {
+		baseLog.Error("backfilling flaggedat", "err", err)
+	}
+	_, err = devices.UpdateAll(bson.M{"cancelled": true, "cancelledtime": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"cancelledtime": time.Now()}})
+	if err != nil {
+		baseLog.Error("backfilling cancelledtime", "err", err)
+	}
+}
+
+// runRetention is called from the anti abuse task and does a retention run if one is due
+func runRetention() {
+	if time.Since(lastRetentionRun) < retentionInterval {
+		return
+	}
+	lastRetentionRun = time.Now()
+	report := PurgeReport{Time: time.Now(), Kind: "retention"}
+	fail := func(what string, err error) {
+		baseLog.Error("retention", "step", what, "err", err)
+		report.Errors = append(report.Errors, what+": "+err.Error())
+	}
+
+	n, err := purgeOldMovables()
+	if err != nil {
+		fail("movables", err)
+	}
+	report.MovablesPurged = n
+
+	cutoff := time.Now().Add(-retainDevices)
+	n, err = anonymiseDevices(bson.M{"anonymised": bson.M{"$ne": true}, "$or": []bson.M{
+		{"hasmovable": true, "completedat": bson.M{"$lt": cutoff}},
+		{"expired": true, "flaggedat": bson.M{"$lt": cutoff}},
+	}})
+	if err != nil {
+		fail("anonymise devices", err)
+	}
+	report.DevicesAnonymised = n
+
+	info, err := msedData.UpdateAll(bson.M{"time": bson.M{"$lt": cutoff}, "miner": bson.M{"$nin": []interface{}{"", nil}}}, bson.M{"$unset": bson.M{"miner": ""}})
+	if err != nil {
+		fail("anonymise msed_data", err)
+	} else {
+		report.MsedsAnonymised = info.Updated
+	}
+
+	info, err = devices.RemoveAll(bson.M{"cancelled": true, "hasmovable": bson.M{"$ne": true}, "cancelledtime": bson.M{"$lt": time.Now().Add(-retainCancelled)}})
+	if err != nil {
+		fail("delete cancelled devices", err)
+	} else {
+		report.DevicesDeleted = info.Removed
+	}
+
+	minerCutoff := time.Now().Add(-retainMiners)
+	info, err = jobEvents.RemoveAll(bson.M{"time": bson.M{"$lt": minerCutoff}})
+	if err != nil {
+		fail("delete job events", err)
+	} else {
+		report.EventsDeleted = info.Removed
+	}
+	// miners with recent events, a job in progress or a recent request are kept
+	var active, mining []string
+	err = jobEvents.Find(nil).Distinct("miner", &active)
+	if err == nil {
+		err = devices.Find(bson.M{"expirytime": bson.M{"$ne": time.Time{}}}).Distinct("miner", &mining)
+	}
+	active = append(active, activeMiners()...)
+	active = append(active, mining...)
+	if err != nil {
+		fail("find active miners", err)
+	} else {
+		// anything still in force or chosen by the miner is kept: bans, suspensions, throttles,
+		// strikes that haven't decayed, names and capabilities
+		info, err = minerCollection.RemoveAll(bson.M{
+			"_id":            bson.M{"$nin": active},
+			"banned":         bson.M{"$ne": true},
+			"suspendeduntil": bson.M{"$not": bson.M{"$gt": time.Now()}},
+			"throttleduntil": bson.M{"$not": bson.M{"$gt": time.Now()}},
+			"strikesexpire":  bson.M{"$not": bson.M{"$gt": time.Now()}},
+			"name":           bson.M{"$exists": false},
+			"capabilities":   bson.M{"$exists": false},
+		})
+		if err != nil {
+			fail("delete miners", err)
+		} else {
+			report.MinersDeleted = info.Removed
+		}
+	}
+
+	if report.empty() == false {
+		baseLog.Info("retention run", "movables", report.MovablesPurged, "anonymised", report.DevicesAnonymised, "mseds", report.MsedsAnonymised, "deleted", report.DevicesDeleted, "miners", report.MinersDeleted, "events", report.EventsDeleted)
+		recordPurge(report)
+	}
+}
+
+// anonymousID is what an anonymised device is stored under instead of its ID0
+func anonymousID(id0 string) string {
+	return "anon:" + msedID(id0)
+}
+
+// anonymiseDevices strips the personal fields from the devices matching selector and moves them
+// from their ID0 to anonymousID, which can't be changed in place
+func anonymiseDevices(selector bson.M) (int, error) {
+	iter := devices.Find(selector).Iter()
+	var doc bson.M
+	n := 0
+	for iter.Next(&doc) {
+		id0, _ := doc["_id"].(string)
+		for field := range personalFields {
+			delete(doc, field)
+		}
+		doc["_id"], doc["anonymised"], doc["msedpurged"] = anonymousID(id0), true, true
+		if err := devices.Insert(doc); err != nil && mgo.IsDup(err) == false {
+			iter.Close()
+			return n, err
+		}
+		if err := devices.RemoveId(id0); err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return n, err
+		}
+		n++
+		doc = bson.M{}
+	}
+	return n, iter.Close()
+}
+
+// deleteDevice is the user's "delete my data", it removes the device and its msed_data contribution,
+// including the file it may have had from before msed_data was kept in the store
+func deleteDevice(id0 string) error {
+	if validID0(id0) == false {
+		return badRequest("invalid id0", nil)
+	}
+	_, err := devices.RemoveAll(bson.M{"_id": bson.M{"$in": []string{id0, anonymousID(id0)}}})
+	if err != nil {
+		return storeError(err)
+	}
+	err = msedData.RemoveId(msedID(id0))
+	if err == nil {
+		staleMsedModel()
+	} else if err != mgo.ErrNotFound {
+		return storeError(err)
+	}
+	if err = clearRanges(id0); err != nil {
+		return storeError(err)
+	}
+	if err = removeLegacyMsed(id0); err != nil {
+		return &httpError{Status: 500, Message: "couldn't delete the old msed_data file", Err: err}
+	}
+	recordPurge(PurgeReport{Time: time.Now(), Kind: "user", DevicesDeleted: 1})
+	return nil
+}
+
+func recordPurge(report PurgeReport) {
+	if err := purgeLog.Insert(report); err != nil {
+		baseLog.Error("recording purge", "err", err)
+	}
+}
+
+// /admin/purges: the last 100 retention runs and user deletions
+func servePurges(w http.ResponseWriter, r *http.Request) {
+	var reports []PurgeReport
+	if err := purgeLog.Find(nil).Sort("-time").Limit(100).All(&reports); err != nil {
+		writeError(w, r, storeError(err))
+		return
+	}
+	writeJSON(w, 200, reports)
+}
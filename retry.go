@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A job that runs out of time while its miner is still checking in, or whose ranges have all been
+// searched, is handed to other miners SEEDHELPER_JOB_RETRIES times before its ID0 is flagged as
+// probably wrong. Each retry gets another hour on top of the last one, so a miner that was too slow
+// gets replaced by one with time to search further, and /part1 tells it where the earlier attempts
+// got to so launchers that read X-Seedhelper-Offset-Start stop further out.
+var jobRetries = envInt("SEEDHELPER_JOB_RETRIES", 1)
+
+// JobAttempt : one go at a job that ended without a movable.sed
+type JobAttempt struct {
+	Miner     string
+	ClaimedAt time.Time
+	EndedAt   time.Time
+	Outcome   string // expired or searched
+	// distance from the msed3 estimate searched up to, as far as the server knows
+	SearchedTo int
+}
+
+// retryJob records a failed attempt and requeues the job for a different miner, or flags it if it is
+// out of retries. It reports whether the job was flagged.
+func retryJob(device Device, attempt JobAttempt) (bool, error) {
+	attempt.EndedAt = time.Now()
+	if device.Progress > attempt.SearchedTo {
+		attempt.SearchedTo = device.Progress
+	}
+	if device.SearchedTo > attempt.SearchedTo {
+		attempt.SearchedTo = device.SearchedTo
+	}
+	l := baseLog.With("id0", device.ID0, "miner", attempt.Miner, "outcome", attempt.Outcome)
+	if err := clearRanges(device.ID0); err != nil {
+		return false, err
+	}
+
+	if device.Retries < jobRetries {
+		err := devices.Update(bson.M{"_id": device.ID0}, bson.M{
+			"$set":  bson.M{"expirytime": time.Time{}, "miner": "", "split": false, "searchedto": attempt.SearchedTo},
+			"$inc":  bson.M{"retries": 1, "failures": 1},
+			"$push": bson.M{"attempts": attempt},
+		})
+		if err != nil {
+			return false, err
+		}
+		jobsMetric.inc("retried")
+		notifyReason(device.ID0, "queue", fmt.Sprintf("Not found yet, searching further (attempt %d of %d)", device.Retries+2, jobRetries+1))
+		l.Info("job requeued for another attempt", "retries", device.Retries+1, "searchedto", attempt.SearchedTo)
+		return false, nil
+	}
+
+	reason := fmt.Sprintf("Your movable.sed wasn't found after %d attempts searching up to %d msed3 offsets either side of the estimate. This is most likely because your ID0 was incorrect.", device.Retries+1, attempt.SearchedTo)
+	if attempt.SearchedTo == 0 {
+		// the miner never said how far it got
+		reason = fmt.Sprintf("Your movable.sed wasn't found after %d attempts. This is most likely because your ID0 was incorrect.", device.Retries+1)
+	}
+	err := devices.Update(bson.M{"_id": device.ID0}, bson.M{
+		"$set":  bson.M{"expirytime": time.Time{}, "miner": "", "wantsbf": false, "expired": true, "flaggedat": time.Now(), "flagreason": reason, "split": false, "searchedto": attempt.SearchedTo},
+		"$push": bson.M{"attempts": attempt},
+	})
+	if err != nil {
+		return false, err
+	}
+	jobsMetric.inc("flagged")
+	notifyReason(device.ID0, "flag", reason)
+	l.Info("job flagged after its last attempt", "attempts", device.Retries+1)
+	return true, nil
+}
+
+// attemptTime is how long a miner gets for a whole job that has been retried this many times, a miner
+// that declared maxtime stops by then anyway
+func attemptTime(caps Capabilities, retries int) time.Duration {
+	if caps.MaxJobTime > 0 {
+		return caps.maxJobTime()
+	}
+	return time.Hour * time.Duration(retries+1)
+}
+
+// deviceMessage is the status frame for a device, flagged devices carry the explanation
+func deviceMessage(device Device) ServerMessage {
+	message := statusMessage(deviceStatus(device))
+	if device.Expired {
+		message.Reason = device.FlagReason
+	}
+	return message
+}
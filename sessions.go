@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// recovery codes leave out letters that are easy to misread
+var recoveryEncoding = base32.NewEncoding("ABCDEFGHJKLMNPQRSTUVWXYZ23456789").WithPadding(base32.NoPadding)
+
+// hashSecret is how tokens and recovery codes are stored, so a database leak doesn't hand out sessions
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSessionToken makes the secret a browser keeps to prove it submitted a device
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newRecoveryCode makes a short code like ABCDE-FGHJK that can be written down to get the token back
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := recoveryEncoding.EncodeToString(b)[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normaliseRecoveryCode lets people type the code in any case, with or without the dash
+func normaliseRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
+
+// checkToken is nil if token may act on device. Devices submitted before sessions existed have no
+// token, so nobody may act on them until the owner claims one with sessionFor or recoverSession.
+func checkToken(device Device, token string) error {
+	if device.TokenHash == "" {
+		return forbidden("this job was started before recovery codes, recover it with its friend code or submit its part1 again")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(token)), []byte(device.TokenHash)) != 1 {
+		return forbidden("wrong or missing session token")
+	}
+	return nil
+}
+
+// hasSecrets is whether a device holds anything of its owner's, a device without any can be claimed by anyone
+func hasSecrets(device Device) bool {
+	return device.FriendCode != 0 || device.LFCS != [8]byte{} || device.LFCSSealed != nil || (device.HasMovable && device.MSedPurged == false)
+}
+
+// issueSession gives id0 a new token and recovery code, the hashes go in the device
+// and the secrets go back to the browser once
+func issueSession() (token string, code string, fields bson.M, err error) {
+	token, err = newSessionToken()
+	if err != nil {
+		return "", "", nil, err
+	}
+	code, err = newRecoveryCode()
+	if err != nil {
+		return "", "", nil, err
+	}
+	return token, code, bson.M{"tokenhash": hashSecret(token), "recoveryhash": hashSecret(code)}, nil
+}
+
+// sessionFor decides the session fields for a submission of id0. A device that already has a session
+// can only be resubmitted with its token and keeps it. A device from before sessions only gets one
+// if owns says the submission proves it is the owner's, by matching what is on file.
+func sessionFor(id0 string, token string, owns func(Device) bool) (newToken string, code string, fields bson.M, err error) {
+	var device Device
+	err = devices.Find(bson.M{"_id": id0}).One(&device)
+	if err != nil && err != mgo.ErrNotFound {
+		return "", "", nil, storeError(err)
+	}
+	if err == nil && device.TokenHash != "" {
+		if checkToken(device, token) != nil {
+			return "", "", nil, forbidden("this ID0 was submitted from another browser, use its recovery code")
+		}
+		return "", "", bson.M{"tokenhash": device.TokenHash, "recoveryhash": device.RecoveryHash}, nil
+	}
+	if err == nil && hasSecrets(device) && owns(device) == false {
+		return "", "", nil, forbidden("this ID0 was submitted before recovery codes, submit the same friend code or part1 to claim it")
+	}
+	return issueSession()
+}
+
+// recoverSession swaps a recovery code for a fresh token, the old token stops working. A device from
+// before sessions has no recovery code, its friend code claims it instead and a recovery code is issued.
+func recoverSession(id0 string, code string) (token string, newCode string, err error) {
+	var device Device
+	err = devices.Find(bson.M{"_id": id0}).One(&device)
+	if err != nil && err != mgo.ErrNotFound {
+		return "", "", storeError(err)
+	}
+	if err == mgo.ErrNotFound {
+		return "", "", forbidden("wrong recovery code")
+	}
+	if device.RecoveryHash == "" {
+		fc, err := parseFriendCode(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+		if err != nil || device.FriendCode == 0 || fc != device.FriendCode {
+			return "", "", forbidden("wrong recovery code")
+		}
+		token, newCode, fields, err := issueSession()
+		if err != nil {
+			return "", "", err
+		}
+		err = devices.Update(bson.M{"_id": id0, "recoveryhash": bson.M{"$in": []interface{}{"", nil}}}, bson.M{"$set": fields})
+		if err == mgo.ErrNotFound {
+			return "", "", forbidden("wrong recovery code")
+		} else if err != nil {
+			return "", "", storeError(err)
+		}
+		return token, newCode, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(normaliseRecoveryCode(code))), []byte(device.RecoveryHash)) != 1 {
+		return "", "", forbidden("wrong recovery code")
+	}
+	token, err = newSessionToken()
+	if err != nil {
+		return "", "", err
+	}
+	err = devices.Update(bson.M{"_id": id0}, bson.M{"$set": bson.M{"tokenhash": hashSecret(token)}})
+	if err != nil {
+		return "", "", storeError(err)
+	}
+	return token, "", nil
+}
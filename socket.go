@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errorMessage is the error frame explaining why a message was rejected
+func errorMessage(err error) []byte {
+	return encodeMessage(ServerMessage{Type: msgError, Status: "error", Reason: reason(err)})
+}
+
+// socketSession : what the server remembers about one websocket
+type socketSession struct {
+	// ID0s submitted on this websocket
+	submitted map[string]bool
+}
+
+// handleSocketMessage acts on one frame from a client and returns the frame to reply with,
+// a nil reply means none is sent
+func handleSocketMessage(l *slog.Logger, client *socketClient, ip string, p []byte, session *socketSession) ([]byte, error) {
+	message, err := parseClientMessage(p)
+	if err != nil {
+		return nil, err
+	}
+	if message.Type == msgHello {
+		if message.Version != protocolVersion {
+			return nil, badRequest("unsupported protocol version "+strconv.Itoa(message.Version)+", the server speaks "+strconv.Itoa(protocolVersion), nil)
+		}
+		return encodeMessage(ServerMessage{Type: msgHello, Version: protocolVersion}), nil
+	}
+	if message.ID0 == "" {
+		// legacy clients send this before they know their ID0
+		return nil, nil
+	}
+	id0 := message.ID0
+	l = l.With("id0", id0, "type", message.Type)
+	l.Debug("identify")
+	watch(id0, client.watcher)
+
+	reply, err := handleDeviceMessage(l, ip, message, session)
+	if err != nil || reply.Type == "" {
+		return nil, err
+	}
+	return encodeMessage(reply), nil
+}
+
+// findDevice loads id0 for a message that needs its session token
+func findDevice(id0 string, token string) (Device, error) {
+	var device Device
+	err := devices.Find(bson.M{"_id": id0}).One(&device)
+	if err == mgo.ErrNotFound {
+		return device, notFound("no such device")
+	} else if err != nil {
+		return device, storeError(err)
+	}
+	return device, checkToken(device, token)
+}
+
+// handleDeviceMessage does what a frame about an ID0 asks and returns the frame to reply with,
+// a reply without a type means none is sent
+func handleDeviceMessage(l *slog.Logger, ip string, message ClientMessage, session *socketSession) (ServerMessage, error) {
+	id0 := message.ID0
+	switch message.Type {
+	case msgRecover:
+		token, code, err := recoverSession(id0, message.Code)
+		if err != nil {
+			l.Info("failed session recovery", "err", err)
+			return ServerMessage{}, err
+		}
+		return ServerMessage{Type: msgSession, Token: token, RecoveryCode: code}, nil
+	case msgDelete:
+		if _, err := findDevice(id0, message.Token); err != nil {
+			return ServerMessage{}, err
+		}
+		if err := deleteDevice(id0); err != nil {
+			return ServerMessage{}, err
+		}
+		l.Info("device deleted by its owner")
+		return statusMessage("deleted"), nil
+	case msgBruteforce:
+		// add to BF pool
+		device, err := findDevice(id0, message.Token)
+		if err != nil {
+			return ServerMessage{}, err
+		}
+		if device.Expired || device.HasMovable {
+			// flagged and finished devices are resubmitted, not requeued
+			return ServerMessage{}, forbidden("this job has already finished")
+		}
+		err = devices.Update(bson.M{"_id": id0}, bson.M{"$set": bson.M{"wantsbf": true, "expirytime": time.Time{}, "split": false, "cancelled": false}})
+		if err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		if err := clearRanges(id0); err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		return ServerMessage{}, nil
+	case msgCancel:
+		// canseru jobbu
+		if _, err := findDevice(id0, message.Token); err != nil {
+			return ServerMessage{}, err
+		}
+		if err := cancelJob(id0); err != nil {
+			return ServerMessage{}, err
+		}
+		return ServerMessage{}, nil
+	case msgPart1:
+		// add to work pool
+		c, err := devices.Find(bson.M{"_id": bson.M{"$in": []string{id0, anonymousID(id0)}}, "expired": true}).Count()
+		if err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		if c > 0 {
+			return statusMessage("flag"), nil
+		}
+		if validID0(id0) == false {
+			return statusMessage("friendCodeInvalid"), nil
+		}
+		lfcsArray, err := parsePart1LFCS(*message.Part1)
+		if err != nil {
+			l.Debug("bad part1", "err", err)
+			return statusMessage("friendCodeInvalid"), nil
+		}
+		if message.DefoID0 != "yes" && checkIfID1(id0) {
+			return statusMessage("couldBeID1"), nil
+		}
+		if status := checkSubmission(ip, id0, session.submitted); status != "" {
+			return statusMessage(status), nil
+		}
+		token, code, device, err := sessionFor(id0, message.Token, func(existing Device) bool {
+			stored, err := deviceLFCS(existing)
+			return err == nil && stored == lfcsArray
+		})
+		if err != nil {
+			return ServerMessage{}, err
+		}
+		session.submitted[id0] = true
+		if err := setSecret(device, nil, id0, "lfcs", lfcsArray[:]); err != nil {
+			return ServerMessage{}, err
+		}
+		device["haspart1"] = true
+		device["hasadded"] = true
+		device["wantsbf"] = true
+		device["expirytime"] = time.Time{}
+		device["split"] = false
+		device["cancelled"] = false
+		device["submitter"] = ip
+		device["submittedat"] = time.Now()
+		_, err = devices.Upsert(bson.M{"_id": id0}, device)
+		if err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		if err := clearRanges(id0); err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		reply := statusMessage("queue")
+		reply.Token, reply.RecoveryCode = token, code
+		return reply, nil
+	case msgFriendCode:
+		// add to bot pool
+		c, err := devices.Find(bson.M{"_id": bson.M{"$in": []string{id0, anonymousID(id0)}}, "expired": true}).Count()
+		if err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		if c > 0 {
+			return statusMessage("flag"), nil
+		}
+		fc, err := parseFriendCode(*message.FriendCode)
+		if err != nil || validID0(id0) == false {
+			l.Debug("bad friend code or id0", "err", err)
+			return statusMessage("friendCodeInvalid"), nil
+		}
+		if message.DefoID0 != "yes" && checkIfID1(id0) == true {
+			return statusMessage("couldBeID1"), nil
+		}
+		if status := checkSubmission(ip, id0, session.submitted); status != "" {
+			return statusMessage(status), nil
+		}
+		token, code, device, err := sessionFor(id0, message.Token, func(existing Device) bool {
+			return existing.FriendCode == fc
+		})
+		if err != nil {
+			return ServerMessage{}, err
+		}
+		session.submitted[id0] = true
+		l.Info("friend code submitted", "fc", fc)
+		device["friendcode"] = fc
+		device["hasadded"] = false
+		device["haspart1"] = false
+		device["cancelled"] = false
+		device["submitter"] = ip
+		device["submittedat"] = time.Now()
+		_, err = devices.Upsert(bson.M{"_id": id0}, device)
+		if err != nil {
+			return ServerMessage{}, storeError(err)
+		}
+		reply := statusMessage("friendCodeProcessing")
+		reply.Token, reply.RecoveryCode = token, code
+		return reply, nil
+	}
+
+	// checc
+	var device Device
+	err := devices.Find(bson.M{"_id": id0}).One(&device)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			l.Warn("unknown id0, dropped DB?")
+			return ServerMessage{}, nil
+		}
+		return ServerMessage{}, storeError(err)
+	}
+	return deviceMessage(device), nil
+}
+
+// deviceStatus is the status a device is in as far as its owner is concerned
+func deviceStatus(device Device) string {
+	if device.HasMovable == true {
+		return "done"
+	} else if device.Expired == true {
+		return "flag"
+	} else if device.Cancelled == true {
+		return "cancelled"
+	} else if (device.ExpiryTime != time.Time{}) {
+		return "bruteforcing"
+	} else if device.WantsBF == true {
+		return "queue"
+	} else if device.HasPart1 == true {
+		return "movablePart1"
+	} else if device.HasAdded == true {
+		return "friendCodeAdded"
+	}
+	return "friendCodeProcessing"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/mgo.v2"
+)
+
+var testStoreOnce sync.Once
+var testSession *mgo.Session
+
+const testDatabase = "seedhelper_test"
+
+// useTestStore points the collections at a scratch database when a MongoDB is running locally,
+// TestMain drops it again. Without one, inputs that would reach the store are skipped.
+func useTestStore() bool {
+	testStoreOnce.Do(func() {
+		session, err := mgo.DialWithTimeout("localhost", time.Second)
+		if err != nil {
+			return
+		}
+		db := session.DB(testDatabase)
+		// whatever an interrupted run left behind
+		db.DropDatabase()
+		devices = db.C("devices")
+		minerCollection = db.C("miners")
+		jobEvents = db.C("jobevents")
+		purgeLog = db.C("purgelog")
+		msedData = db.C("mseds")
+		counters = db.C("counters")
+		msedModels = db.C("models")
+		jobRanges = db.C("ranges")
+		testSession = session
+	})
+	return testSession != nil
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testSession != nil {
+		testSession.DB(testDatabase).DropDatabase()
+		testSession.Close()
+	}
+	os.Exit(code)
+}
+
+// resetLimits forgets every client's rate limit and abuse counts, fuzz inputs all come from one
+// address and would otherwise be rate limited or throttled after the first few
+func resetLimits() {
+	socketLimiter.Lock()
+	socketLimiter.buckets = map[string]*bucket{}
+	socketLimiter.Unlock()
+	abuse.Lock()
+	abuse.events = map[string]map[string][]time.Time{}
+	abuse.throttled = map[string]time.Time{}
+	abuse.Unlock()
+}
+
+// needsStore is whether handleSocketMessage would go past parsing for p
+func needsStore(p []byte) bool {
+	message, err := parseClientMessage(p)
+	return err == nil && message.Type != msgHello && message.ID0 != ""
+}
+
+func FuzzSocketMessage(f *testing.F) {
+	// frames that panicked the handler before it was typed
+	f.Add([]byte(`{"id0":1}`))
+	f.Add([]byte(`{"id0":"0123456789abcdef0123456789abcdef","part1":""}`))
+	f.Add([]byte(`{"id0":"0123456789abcdef0123456789abcdef","part1":5}`))
+	f.Add([]byte(`{"id0":"0123456789abcdef0123456789abcdef","friendCode":5}`))
+	f.Add([]byte(`{"id0":"aa","friendCode":"1","defoID0":"no"}`))
+	f.Add([]byte(`{"type":"hello","version":1}`))
+	f.Add([]byte(`{"type":"recover","id0":"x"}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+
+	server := httptest.NewServer(http.HandlerFunc(serveSocket))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		if needsStore(p) && useTestStore() == false {
+			return
+		}
+		resetLimits()
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// not every frame is answered, the hello after it always is
+		hello := []byte(`{"type":"hello","version":1}`)
+		if err := conn.WriteMessage(websocket.TextMessage, p); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, reply, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("no answer to %q: %v", p, err)
+			}
+			var message ServerMessage
+			if err := json.Unmarshal(reply, &message); err != nil {
+				t.Fatalf("reply to %q isn't JSON: %q", p, reply)
+			}
+			if message.Type == msgHello {
+				return
+			}
+		}
+	})
+}
+
+// FuzzClientMessage runs the field parsers on whatever a frame decodes to, including the ones
+// handleDeviceMessage only reaches with a store
+func FuzzClientMessage(f *testing.F) {
+	f.Add([]byte(`{"id0":"0123456789abcdef0123456789abcdef","part1":"AAAA"}`))
+	f.Add([]byte(`{"id0":"zz","friendCode":"27599290078"}`))
+	f.Add([]byte(`{"request":"bruteforce","id0":"0123456789abcdef0123456789abcdef"}`))
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		message, err := parseClientMessage(p)
+		if err != nil {
+			return
+		}
+		validID0(message.ID0)
+		checkIfID1(message.ID0)
+		if message.FriendCode != nil {
+			parseFriendCode(*message.FriendCode)
+		}
+		if message.Part1 != nil {
+			if lfcs, err := parsePart1LFCS(*message.Part1); err == nil && lfcs == [8]byte{} {
+				t.Fatalf("blank LFCS accepted from %q", p)
+			}
+		}
+	})
+}
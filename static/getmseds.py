@@ -1,18 +1,12 @@
 #!/usr/bin/env python3
 
-import requests
+import io
+import tarfile
 
-# https://stackoverflow.com/a/16696317 thx
-def download_file(url, local_filename):
-    # NOTE the stream=True parameter
-    r = requests.get(url, stream=True)
-    with open(local_filename, 'wb') as f:
-        for chunk in r.iter_content(chunk_size=1024):
-            if chunk: # filter out keep-alive new chunks
-                f.write(chunk)
-                #f.flush() commented by recommendation from J.F.Sebastian
-    return local_filename
+import requests
 
-r = requests.get("https://seedhelper.figgyc.uk/static/mseds/list")
-for line in r.text.splitlines():
-    download_file("https://seedhelper.figgyc.uk/static/mseds/" + line, line)
\ No newline at end of file
+# every msed_data contribution as msed_data_<id0 hash>.bin files, see /mseds/v1/export
+r = requests.get("https://seedhelper.figgyc.uk/mseds/v1/export", params={"format": "tar"}, stream=True)
+r.raise_for_status()
+with tarfile.open(fileobj=io.BytesIO(r.content)) as tar:
+    tar.extractall()
@@ -74,40 +74,109 @@ let socket = new WebSocket("wss://" + location.host + "/socket")
 let force = "no"
 
 socket.addEventListener("open", (e) => {
+    socket.send(JSON.stringify({
+        type: "hello",
+        version: 1
+    }))
     if (localStorage.getItem("id0") != null) {
         // send intro packet, if we get anything back then stuff will happen
         socket.send(JSON.stringify({
+            type: "identify",
             id0: localStorage.getItem("id0")
         }))
     }
     setInterval(() => {
         // send id0 packet, its a good fallback as well as providing 'live' stats
-        socket.send(JSON.stringify({
-            id0: localStorage.getItem("id0")
-        }))
+        if (localStorage.getItem("id0") != null) {
+            socket.send(JSON.stringify({
+                type: "identify",
+                id0: localStorage.getItem("id0")
+            }))
+        }
     }, 60000)
 })
 
-socket.addEventListener("close", () => {
-    document.getElementById("navbar").classList.remove("bg-primary")
-    document.getElementById("statusText").innerText = "Refresh the page"
-    document.getElementById("navbar").classList.add("bg-warning")
-    setTimeout(() => {
-        window.location.reload(true)
-    }, 10000)
-})
-socket.addEventListener("error", () => {
+let events = null
+
+function socketFailed() {
+    // websockets can be broken by proxies, keep following the job with server sent events instead
+    if (events == null && window.EventSource && localStorage.getItem("id0") != null) {
+        events = new EventSource("/events/" + localStorage.getItem("id0"))
+        events.addEventListener("message", handleMessage)
+        return
+    }
+    if (events != null) {
+        return
+    }
     document.getElementById("navbar").classList.remove("bg-primary")
     document.getElementById("statusText").innerText = "Refresh the page"
     document.getElementById("navbar").classList.add("bg-warning")
     setTimeout(() => {
         window.location.reload(true)
     }, 10000)
-})
+}
 
-socket.addEventListener("message", (e) => {
+socket.addEventListener("close", socketFailed)
+socket.addEventListener("error", socketFailed)
+
+// downloadMovable fetches the movable.sed with the session token in a header, so the token never
+// ends up in a URL, the browser history or a Referer
+function downloadMovable(e) {
+    e.preventDefault()
+    fetch("/movable/" + localStorage.getItem("id0"), {
+        headers: { "X-Seedhelper-Token": localStorage.getItem("token") || "" },
+        cache: "no-store"
+    }).then(res => {
+        if (!res.ok) {
+            return res.text().then(text => { throw new Error(text) })
+        }
+        return res.blob()
+    }).then(blob => {
+        let a = document.createElement("a")
+        a.href = URL.createObjectURL(blob)
+        a.download = "movable.sed"
+        document.body.appendChild(a)
+        a.click()
+        a.remove()
+        URL.revokeObjectURL(a.href)
+    }).catch(err => {
+        alert("Couldn't download movable.sed: " + err.message)
+    })
+}
+
+function handleMessage(e) {
     let data = JSON.parse(e.data)
-    document.getElementById("statusText").innerText = `${data.minerCount} miners are online, ${data.userCount} users in the mining queue, ${data.miningCount} are being mined, ${data.totalCount} total users, ${data.p1count} got part1, ${data.msCount} got movable`
+    if (data.type == "hello") {
+        return
+    }
+    if (data.type == "session") {
+        // recovered from another browser, pick the job back up
+        localStorage.setItem("token", data.token)
+        localStorage.setItem("id0", document.getElementById("id0").value)
+        if (data.recoveryCode) {
+            // older jobs are claimed with their friend code and get a recovery code now
+            localStorage.setItem("recoveryCode", data.recoveryCode)
+        }
+        document.getElementById("recoverForm").style.display = "none"
+        socket.send(JSON.stringify({
+            type: "identify",
+            id0: localStorage.getItem("id0")
+        }))
+        return
+    }
+    if (data.token) {
+        localStorage.setItem("token", data.token)
+    }
+    if (data.recoveryCode) {
+        localStorage.setItem("recoveryCode", data.recoveryCode)
+    }
+    if (localStorage.getItem("recoveryCode") != null) {
+        document.getElementById("recoveryCodeFill").innerText = localStorage.getItem("recoveryCode")
+        document.getElementById("recoveryCodeInfo").style.display = "block"
+    }
+    if (data.type == "status") {
+        document.getElementById("statusText").innerText = `${data.minerCount} miners are online, ${data.userCount} users in the mining queue, ${data.miningCount} are being mined, ${data.totalCount} total users, ${data.p1Count} got part1, ${data.msCount} got movable`
+    }
     //console.log("hey!", e.data, data.status)
     if (data.status == "friendCodeAdded") {
         /* 
@@ -147,8 +216,8 @@ socket.addEventListener("message", (e) => {
         document.getElementById("collapseThree").classList.remove("show")
         document.getElementById("collapseFour").classList.remove("show")
         document.getElementById("collapseFive").classList.add("show")
-        document.getElementById("downloadMovable").href = "/movable/" + localStorage.getItem("id0")
-        document.getElementById("downloadMovable2").href = "/movable/" + localStorage.getItem("id0")
+        document.getElementById("downloadMovable").onclick = downloadMovable
+        document.getElementById("downloadMovable2").onclick = downloadMovable
     }
     if (data.status == "flag") {
         /* 
@@ -162,6 +231,9 @@ socket.addEventListener("message", (e) => {
         document.getElementById("fcError").style.display = "block"
         document.getElementById("beginButton").disabled = true
         document.getElementById("fcError").innerText = "Your movable.sed took to long to bruteforce. This is most likely because your ID0 was incorrect. You will need to ask for help on the "
+        if (data.reason) {
+            document.getElementById("fcError").innerText = data.reason + " You will need to ask for help on the "
+        }
         let link = document.createElement("a")
         link.innerText = "Nintendo Homebrew Discord."
         link.href = "https://discord.gg/C29hYvh"
@@ -179,6 +251,9 @@ socket.addEventListener("message", (e) => {
         document.getElementById("bfProgress").classList.remove("bg-warning")
         document.getElementById("id0Fill").innerText = localStorage.getItem("id0")
         document.getElementById("bfProgress").innerText = "Waiting..."
+        if (data.reason) {
+            document.getElementById("bfProgress").innerText = "Waiting... " + data.reason
+        }
     }
     if (data.status == "bruteforcing") {
         /* 
@@ -193,11 +268,40 @@ socket.addEventListener("message", (e) => {
         document.getElementById("id0Fill").innerText = localStorage.getItem("id0")
         document.getElementById("bfProgress").innerText = "Bruteforcing..."
     }
+    if (data.status == "tooManySubmissions") {
+        document.getElementById("fcProgress").style.display = "none"
+        document.getElementById("fcError").style.display = "block"
+        document.getElementById("fcError").innerText = "You already have too many devices waiting. Wait for them to finish or cancel them before adding another one."
+        document.getElementById("beginButton").disabled = false
+    }
+    if (data.status == "cancelCooldown") {
+        document.getElementById("fcProgress").style.display = "none"
+        document.getElementById("fcError").style.display = "block"
+        document.getElementById("fcError").innerText = "This ID0 was cancelled recently. Wait a few minutes before submitting it again."
+        document.getElementById("beginButton").disabled = false
+    }
+    if (data.status == "deleted") {
+        localStorage.clear()
+        location.reload(true)
+    }
+    if (data.status == "cancelled") {
+        // the token stays so the same ID0 can be resubmitted once the cooldown is over
+        localStorage.removeItem("id0")
+        location.reload(true)
+    }
+    if (data.status == "rateLimited") {
+        document.getElementById("statusText").innerText = "You are sending requests too quickly, slow down"
+    }
+    if (data.status == "error") {
+        document.getElementById("statusText").innerText = "Something went wrong: " + data.reason
+    }
     if (data.status == "couldBeID1") {
         document.getElementById("fcProgress").style.display = "none"
         document.getElementById("fcWarning").style.display = "block"
     }
-})
+}
+
+socket.addEventListener("message", handleMessage)
 
 /*
     Step 0?: parse preprovided part1
@@ -256,19 +360,44 @@ document.getElementById("beginButton").addEventListener("click", (e) => {
     localStorage.setItem("id0", document.getElementById("id0").value)
     if (document.getElementById("part1b64").value != "") {
         socket.send(JSON.stringify({
+            type: "part1",
             part1: document.getElementById("part1b64").value,
             defoID0: force,
             id0: document.getElementById("id0").value,
+            token: localStorage.getItem("token")
         }))
     } else {
         socket.send(JSON.stringify({
+            type: "friendCode",
             friendCode: document.getElementById("friendCode").value,
             id0: document.getElementById("id0").value,
-            defoID0: force
+            defoID0: force,
+            token: localStorage.getItem("token")
         }))
     }
 })
 
+/*
+    recover a job started in another browser
+    recoverLink a
+    recoveryCode input box
+    recoverButton button
+*/
+document.getElementById("recoverLink").addEventListener("click", (e) => {
+    e.preventDefault()
+    document.getElementById("recoverForm").style.display = "block"
+})
+
+document.getElementById("recoverButton").addEventListener("click", (e) => {
+    e.preventDefault()
+    document.getElementById("id0").value = document.getElementById("id0").value.toLowerCase()
+    socket.send(JSON.stringify({
+        type: "recover",
+        id0: document.getElementById("id0").value,
+        code: document.getElementById("recoveryCode").value
+    }))
+})
+
 /*
     Step 4: wait for BF
     continue button
@@ -277,8 +406,9 @@ document.getElementById("continue").addEventListener("click", (e) => {
     e.preventDefault()
     //document.getElementById("").setAttribute()
     socket.send(JSON.stringify({
-        request: "bruteforce",
+        type: "bruteforce",
         id0: localStorage.getItem("id0"),
+        token: localStorage.getItem("token")
     }))
     document.getElementById("collapseThree").classList.remove("show")
     document.getElementById("collapseFour").classList.add("show")
@@ -318,12 +448,13 @@ function cancel (e) {
     document.getElementById("cancelButton").disabled = true
     document.getElementById("downloadPart1").click()
     socket.send(JSON.stringify({
-        request: "cancel",
+        type: "cancel",
         id0: document.getElementById("id0").value,
+        token: localStorage.getItem("token")
     }))
     document.getElementById("collapseFour").classList.remove("show")
     document.getElementById("collapseOne").classList.add("show")
-    localStorage.clear();
+    localStorage.removeItem("id0");
     location.reload(true);
 }
 
@@ -331,3 +462,18 @@ document.getElementById("cancelButton").addEventListener("click", cancel)
 document.getElementById("cancelButton1").addEventListener("click", cancel)
 document.getElementById("cancelButton2").addEventListener("click", cancel)
 document.getElementById("cancelButton3").addEventListener("click", cancel)
+
+/*
+    delete my data
+*/
+document.getElementById("deleteButton").addEventListener("click", (e) => {
+    e.preventDefault()
+    if (!confirm("Delete everything stored about this device, including its movable.sed?")) {
+        return
+    }
+    socket.send(JSON.stringify({
+        type: "delete",
+        id0: localStorage.getItem("id0"),
+        token: localStorage.getItem("token")
+    }))
+})
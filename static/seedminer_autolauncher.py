@@ -18,7 +18,9 @@ import pickle
 s = requests.Session()
 baseurl = "https://seedhelper.figgyc.uk"
 currentid = ""
-currentVersion = "2.1.1"
+currentVersion = "2.2.0"
+# sent on /getwork and /claim so the server can turn away outdated launchers
+capabilities = {"version": currentVersion}
 
 if os.path.isfile("total_mined"):
     with open("total_mined", "rb") as file:
@@ -40,13 +42,18 @@ def download_file(url, local_filename):
     return local_filename
 
 
-print("Checking for updates...")
-r0 = s.get(baseurl + "/static/autolauncher_version")
-if r0.text != currentVersion:
+def update():
     print("Updating")
     download_file(baseurl + "/static/seedminer_autolauncher.py",
                   "seedminer_autolauncher.py")
     os.system('"' + sys.executable + '" seedminer_autolauncher.py')
+    sys.exit(0)
+
+
+print("Checking for updates...")
+r0 = s.get(baseurl + "/static/autolauncher_version")
+if r0.text != currentVersion:
+    update()
 
 print("Updating seedminer db...")
 os.system('"' + sys.executable + '" seedminer_launcher3.py update-db')
@@ -108,19 +115,27 @@ while True:
     try:
         print("Finding work...")
         try:
-            r = s.get(baseurl + "/getwork")
+            r = s.get(baseurl + "/getwork", params=capabilities)
         except:
             print("Error. Waiting 30 seconds...")
             time.sleep(30)
             continue
-        if r.text == "nothing":
+        if r.status_code == 426:
+            # the body says why, it is not an ID0
+            print(r.text)
+            update()
+        if r.status_code != 200 or r.text == "nothing":
             print("No work. Waiting 30 seconds...")
             time.sleep(30)
         else:
             currentid = r.text
-            r2 = s.get(baseurl + "/claim/" + currentid)
-            if r2.text == "error":
+            r2 = s.get(baseurl + "/claim/" + currentid, params=capabilities)
+            if r2.status_code == 426:
+                print(r2.text)
+                update()
+            if r2.text != "success":
                 print("Device already claimed, trying again...")
+                currentid = ""
             else:
                 print("Downloading part1 for device " + currentid)
                 download_file(baseurl + '/part1/' +
@@ -147,7 +162,8 @@ while True:
                     #    break
                     if timer % 30 == 0:
                         r3 = s.get(baseurl + "/check/" + currentid)
-                        if r3.text != "ok":
+                        # "wait" is a rate limited check, the job carries on
+                        if r3.text != "ok" and r3.text != "wait":
                             print("Job cancelled or expired, killing...")
                             # process.kill() broke
                             subprocess.call(
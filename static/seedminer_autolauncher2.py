@@ -9,6 +9,9 @@ except ImportError:
     print('The new seedhelper script uses aiohttp. Run "pip install aiohttp" in an admin command prompt')
 
 currentversion = "3.0"
+# sent on /getwork and /claim so the server can turn away outdated launchers
+# ranges=1: if our job is split, /check answers "range <range> <start> <end>" and we stop at end
+capabilities = {'version': currentversion, 'ranges': '1'}
 enableupdater = False
 baseurl = "https://seedhelper.figgyc.uk"
 chunk_size = 1024^2
@@ -34,6 +37,7 @@ async def download(session, url, filename):
                 if not chunk:
                     break
                 fd.write(chunk)
+        return resp.headers
 
 async def main():
     async with aiohttp.ClientSession() as session:
@@ -88,95 +92,131 @@ async def main():
                     json.dump(config, file)
         while exitnextflag == False:
             sys.stdout.write("\rSearching for work...          ")
-            async with session.get(baseurl + '/getwork') as resp:
+            id0 = ''
+            # a range of a split job, {'range': index}, empty while mining a whole job
+            rangeparams = {}
+            end = None
+            async with session.get(baseurl + '/getwork', params=capabilities) as resp:
                 text = await resp.text()
                 if text == banMsg:
                     print(text)
                     return
-                if text == "nothing":
-                    sys.stdout.write("\rNo work, waiting 10 seconds...")
-                    time.sleep(10)
-                    continue
-                id0 = text
-                print("Mining " + id0)
-                try:
-                    async with session.get(baseurl + '/claim/' + id0) as resp:
+                if resp.status == 426:
+                    # the body says why and what to download, it is not an ID0
+                    print(text)
+                    return
+                if resp.status == 200 and text != "nothing":
+                    id0 = text
+            if id0 == '':
+                # no whole jobs, help with one that is already being mined
+                async with session.get(baseurl + '/getrange', params=capabilities) as resp:
+                    text = await resp.text()
+                    if resp.status == 426:
+                        print(text)
+                        return
+                    parts = text.split(' ')
+                    if resp.status != 200 or len(parts) != 4:
+                        sys.stdout.write("\rNo work, waiting 10 seconds...")
+                        time.sleep(10)
+                        continue
+                    id0 = parts[0]
+                    rangeparams = {'range': parts[1]}
+                    end = int(parts[3])
+            print("Mining " + id0 + (" range " + rangeparams['range'] if rangeparams else ""))
+            try:
+                if not rangeparams:
+                    async with session.get(baseurl + '/claim/' + id0, params=capabilities) as resp:
                         text = await resp.text()
-                        if text == "error":
+                        if resp.status == 426:
+                            print(text)
+                            return
+                        if text != "success":
                             print("Claim failed, probably someone else got it first.")
+                            id0 = ''
                             time.sleep(10)
                             continue
-                        await download(session, baseurl + '/part1/' + id0, 'movable_part1.sed')
-                        process = await asyncio.create_subprocess_exec(sys.executable, 'seedminer_launcher3.py', 'gpu', stdout=asyncio.subprocess.PIPE, cwd=os.getcwd(), stdin=asyncio.subprocess.PIPE)
-                        n = 400
-                        while process.returncode == None:
-                            if killflag != 0:
-                                async with session.get(baseurl + '/cancel/' + id0 + '?kill=' + ('y' if killflag == 1 else 'n')) as resp:
-                                    text = await resp.text()
-                                    if text == "error":
-                                        print("Cancel error")
-                                        continue
-                                    else: 
-                                        print("Killed/requeued.")
-                                    id0 = ''
-                                    print('Press Ctrl-C again to quit or wait to find another job')
-                                    time.sleep(5)
-                                    continue
-                            data = await process.stdout.readuntil(b'\r')
-                            line = data.decode('ascii')
-                            if writeflag:
-                                sys.stdout.write(line)
-                                sys.stdout.flush()
-                            if 'New3DS msed' in line:
-                                n = 200
-                            offset = int(offsetre.match(line).group(1))
-                            if offset != None:
-                                if offset >= n:
+                headers = await download(session, baseurl + '/part1/' + id0, 'movable_part1.sed')
+                # a retried job has already been searched this far, so search past it. seedminer always
+                # starts at the estimate, so a range is searched by going as far as its end.
+                start = int(headers.get('X-Seedhelper-Offset-Start', '0'))
+                process = await asyncio.create_subprocess_exec(sys.executable, 'seedminer_launcher3.py', 'gpu', stdout=asyncio.subprocess.PIPE, cwd=os.getcwd(), stdin=asyncio.subprocess.PIPE)
+                n = end if end != None else start + 400
+                searched = False
+                while process.returncode == None:
+                    if killflag != 0:
+                        async with session.get(baseurl + '/cancel/' + id0, params=dict(rangeparams, kill='y' if killflag == 1 else 'n')) as resp:
+                            text = await resp.text()
+                            if text == "error":
+                                print("Cancel error")
+                                continue
+                            else:
+                                print("Killed/requeued.")
+                            id0 = ''
+                            print('Press Ctrl-C again to quit or wait to find another job')
+                            time.sleep(5)
+                            continue
+                    data = await process.stdout.readuntil(b'\r')
+                    line = data.decode('ascii')
+                    if writeflag:
+                        sys.stdout.write(line)
+                        sys.stdout.flush()
+                    if 'New3DS msed' in line and end == None:
+                        n = start + 200
+                    offset = int(offsetre.match(line).group(1))
+                    if offset != None:
+                        if abs(offset) >= n:
+                            process.kill()
+                            searched = True
+                            break
+                        if offset % 5 == 0:
+                            async with session.get(baseurl + '/check/' + id0, params=dict(rangeparams, offset=abs(offset))) as resp:
+                                text = await resp.text()
+                                if text.startswith('range '):
+                                    # our job was split for other miners to help, we keep the first range
+                                    parts = text.split(' ')
+                                    rangeparams = {'range': parts[1]}
+                                    end = n = int(parts[3])
+                                elif text == "error":
+                                    print('Job expired, killing...')
                                     process.kill()
                                     break
-                                if offset % 5 == 0:
-                                    async with session.get(baseurl + '/check/' + id0) as resp:
-                                        text = await resp.text()
-                                        if text == "error":
-                                            print('Job expired, killing...')
-                                            process.kill()
-                                            break
 
-                                    
-                            
-                        if returncode != 0:
-                            raise Exception("Process returncode not 0")
-                        
-                        if os.path.isfile("movable.sed"):
-                            print("Uploading...")
-                            list_of_files = glob.glob('msed_data_*.bin')
-                            latest_file = max(list_of_files, key=os.path.getctime)
-                            async with session.post(baseurl + '/upload/' + id0, data={'movable': open('movable.sed', 'rb'), 'msed': open(latest_file, 'rb')}) as resp:
-                                text = await resp.text()
-                                if text == 'success':
-                                    print('Upload succeeded!')
-                                    os.remove('movable.sed')
-                                    os.remove(latest_file)
-                                    id0 = ''
-                                    time.sleep(5)
-                                else:
-                                    raise Exception("Upload failed")
-                        else:
-                            raise FileNotFoundError("movable.sed is not generated")
-                except Exception as e:
-                    print("Error, cancelling...")
-                    print(e)
-                    async with session.get(baseurl + '/cancel/' + id0) as resp:
+                if os.path.isfile("movable.sed"):
+                    print("Uploading...")
+                    list_of_files = glob.glob('msed_data_*.bin')
+                    latest_file = max(list_of_files, key=os.path.getctime)
+                    async with session.post(baseurl + '/upload/' + id0, data={'movable': open('movable.sed', 'rb'), 'msed': open(latest_file, 'rb')}) as resp:
                         text = await resp.text()
-                        if text == "error":
-                            print("Cancel error")
-                        else: 
-                            print("Cancelled")
-                        time.sleep(10)
-                        continue
-
+                        if text == 'success':
+                            print('Upload succeeded!')
+                            os.remove('movable.sed')
+                            os.remove(latest_file)
+                            id0 = ''
+                            time.sleep(5)
+                        else:
+                            raise Exception("Upload failed")
+                elif searched:
+                    # searched as far as we go without finding it, someone else searches further
+                    async with session.get(baseurl + '/abandon/' + id0, params=rangeparams) as resp:
+                        print("Not found, abandoned")
+                    id0 = ''
+                elif id0 != '':
+                    raise FileNotFoundError("movable.sed is not generated")
+            except Exception as e:
+                print("Error, releasing the job...")
+                print(e)
+                async with session.get(baseurl + '/release/' + id0, params=rangeparams) as resp:
+                    text = await resp.text()
+                    if text == "error":
+                        print("Cancel error")
+                    else:
+                        print("Released")
+                id0 = ''
                 time.sleep(10)
-            
+                continue
+
+            time.sleep(10)
+
 def signal_handler(signal, frame):
     if id0 != '':
         writeflag = False
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// how many recent solve times are kept per miner for the averages
+const solveTimeSamples = 100
+
+// miners below this reliability are not given jobs that have already failed once
+var minReliability = 0.5
+
+// MinerStats : per miner job counters and derived figures, stored inline in the miner record
+type MinerStats struct {
+	Claimed      int
+	Completed    int
+	Expired      int
+	Cancelled    int
+	SolveTimes   []float64 // seconds, most recent last
+	AvgSolveTime float64
+	P50SolveTime float64
+	P90SolveTime float64
+	Hashrate     float64 // as reported by the miner
+	Reliability  float64
+}
+
+// reliability is the smoothed fraction of claimed jobs that the miner finished,
+// a new miner starts at 0.5 and it moves towards their real record as they mine
+func reliability(m MinerStats) float64 {
+	return float64(m.Completed+1) / float64(m.Completed+m.Expired+m.Cancelled+2)
+}
+
+// percentile of already sorted values, p between 0 and 1
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+// refreshStats recomputes the derived figures after a counter has changed
+func refreshStats(ip string) {
+	var miner Miner
+	err := minerCollection.Find(bson.M{"_id": ip}).One(&miner)
+	if err != nil {
+		baseLog.Error("finding miner", "miner", ip, "err", err)
+		return
+	}
+	m := miner.MinerStats
+	sorted := append([]float64(nil), m.SolveTimes...)
+	sort.Float64s(sorted)
+	var total float64
+	for _, t := range sorted {
+		total += t
+	}
+	set := bson.M{"reliability": math.Round(reliability(m)*100) / 100, "p50solvetime": percentile(sorted, 0.5), "p90solvetime": percentile(sorted, 0.9), "avgsolvetime": 0.0}
+	if len(sorted) > 0 {
+		set["avgsolvetime"] = math.Round(total / float64(len(sorted)))
+	}
+	err = minerCollection.Update(bson.M{"_id": ip}, bson.M{"$set": set})
+	if err != nil {
+		baseLog.Error("saving miner stats", "miner", ip, "err", err)
+	}
+}
+
+// updateStats applies a change to a miner's counters and refreshes the derived figures
+func updateStats(ip string, update bson.M) {
+	if ip == "" {
+		return
+	}
+	_, err := minerCollection.Upsert(bson.M{"_id": ip}, update)
+	if err != nil {
+		baseLog.Error("saving miner stats", "miner", ip, "err", err)
+		return
+	}
+	refreshStats(ip)
+}
+
+func statsClaimed(ip string) {
+	updateStats(ip, bson.M{"$inc": bson.M{"claimed": 1}})
+}
+
+func statsCompleted(ip string, solveTime time.Duration) {
+	update := bson.M{"$inc": bson.M{"completed": 1}}
+	if solveTime > 0 {
+		update["$push"] = bson.M{"solvetimes": bson.M{"$each": []float64{solveTime.Seconds()}, "$slice": -solveTimeSamples}}
+	}
+	updateStats(ip, update)
+}
+
+func statsExpired(ip string) {
+	updateStats(ip, bson.M{"$inc": bson.M{"expired": 1}})
+}
+
+func statsCancelled(ip string) {
+	updateStats(ip, bson.M{"$inc": bson.M{"cancelled": 1}})
+}
+
+// statsHashrate stores the hashrate a miner reports, ignored if it doesn't parse
+func statsHashrate(ip string, hashrate float64) {
+	if hashrate <= 0 {
+		return
+	}
+	_, err := minerCollection.Upsert(bson.M{"_id": ip}, bson.M{"$set": bson.M{"hashrate": hashrate}})
+	if err != nil {
+		baseLog.Error("saving hashrate", "miner", ip, "err", err)
+	}
+}
+
+// isReliable reports whether a miner should be trusted with jobs that have already failed
+func isReliable(ip string) bool {
+	var miner Miner
+	err := minerCollection.Find(bson.M{"_id": ip}).One(&miner)
+	if err != nil {
+		// unknown miners get the benefit of the doubt
+		return true
+	}
+	return reliability(miner.MinerStats) >= minReliability
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// how many unfinished devices one IP or one websocket may have at once
+var maxSubmissions = envInt("SEEDHELPER_MAX_SUBMISSIONS", 3)
+
+// how long an ID0 has to wait after being cancelled before it can be submitted again
+var cancelCooldown = envDuration("SEEDHELPER_CANCEL_COOLDOWN", 10*time.Minute)
+
+// how long a device that hasn't reached the bruteforce queue counts as outstanding, one left waiting
+// for the bot or its part1 stops counting after this
+var submissionTimeout = envDuration("SEEDHELPER_SUBMISSION_TIMEOUT", 24*time.Hour)
+
+// outstanding narrows selector to devices that still count against the limits: queued or being
+// mined, or submitted lately and still on their way to the queue
+func outstanding(selector bson.M) bson.M {
+	selector["hasmovable"] = bson.M{"$ne": true}
+	selector["cancelled"] = bson.M{"$ne": true}
+	selector["expired"] = bson.M{"$ne": true}
+	selector["$or"] = []bson.M{{"wantsbf": true}, {"submittedat": bson.M{"$gt": time.Now().Add(-submissionTimeout)}}}
+	return selector
+}
+
+// checkSubmission decides whether ip may submit id0, session is the set of ID0s already
+// submitted on this websocket. Both limits only count the ones still outstanding. It returns the
+// status to send back, or "" if it is allowed. The cancel cooldown applies to the owner as well,
+// otherwise cancelling and resubmitting could be looped to jump the queue.
+func checkSubmission(ip string, id0 string, session map[string]bool) string {
+	n, err := devices.Find(bson.M{"_id": id0, "cancelled": true, "cancelledtime": bson.M{"$gt": time.Now().Add(-cancelCooldown)}}).Count()
+	if err != nil {
+		baseLog.Error("checking cancel cooldown", "id0", id0, "err", err)
+	} else if n > 0 {
+		return "cancelCooldown"
+	}
+	others := make([]string, 0, len(session))
+	for submitted := range session {
+		if submitted != id0 {
+			others = append(others, submitted)
+		}
+	}
+	n, err = devices.Find(outstanding(bson.M{"_id": bson.M{"$in": others}})).Count()
+	if err != nil {
+		baseLog.Error("counting session submissions", "err", err)
+	} else if n >= maxSubmissions {
+		return "tooManySubmissions"
+	}
+	n, err = devices.Find(outstanding(bson.M{"_id": bson.M{"$ne": id0}, "submitter": ip})).Count()
+	if err != nil {
+		baseLog.Error("counting submissions", "err", err)
+	} else if n >= maxSubmissions {
+		return "tooManySubmissions"
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+var id0Pattern = regexp.MustCompile("^[0-9a-fA-F]{32}$")
+
+// the part1 bot's own friend code
+const botFriendCode = 27599290078
+
+func validID0(id0 string) bool {
+	return id0Pattern.MatchString(id0)
+}
+
+// parseFriendCode checks a friend code's range and checksum, based on
+// https://github.com/ihaveamac/Kurisu/blob/master/addons/friendcode.py#L24
+func parseFriendCode(s string) (uint64, error) {
+	fc, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if fc > 0x7FFFFFFFFF {
+		return 0, errors.New("friend code too big")
+	}
+	if fc == botFriendCode {
+		return 0, errors.New("that is the bot's friend code")
+	}
+	principalID := fc & 0xFFFFFFFF
+	checksum := (fc & 0xFF00000000) >> 32
+
+	pidb := make([]byte, 4)
+	binary.LittleEndian.PutUint32(pidb, uint32(principalID))
+	if uint64(sha1.Sum(pidb)[0])>>1 != checksum {
+		return 0, errors.New("friend code checksum is wrong")
+	}
+	return fc, nil
+}
+
+// parsePart1LFCS gets the LFCS out of the base64 start of a movable_part1.sed
+func parsePart1LFCS(part1 string) ([8]byte, error) {
+	var lfcs [8]byte
+	p1Slice, err := base64.StdEncoding.DecodeString(part1)
+	if err != nil {
+		return lfcs, err
+	}
+	if len(p1Slice) < 8 {
+		return lfcs, errors.New("part1 too short")
+	}
+	lfcsSlice := p1Slice[:8]
+	reverse(lfcsSlice)
+	copy(lfcs[:], lfcsSlice)
+	if lfcs == [8]byte{} {
+		return lfcs, errors.New("part1 is blank")
+	}
+	return lfcs, nil
+}
+
+// readMovable gets the movable.sed out of an /upload form. seedminer writes 0x120 or 0x140
+// bytes, only the first 0x120 are kept.
+func readMovable(r *http.Request) ([0x120]byte, error) {
+	var movable [0x120]byte
+	file, header, err := r.FormFile("movable")
+	if err != nil {
+		return movable, badRequest("upload without movable", err)
+	}
+	defer file.Close()
+	if header.Size != 0x120 && header.Size != 0x140 {
+		return movable, badRequest("movable is the wrong size", nil)
+	}
+	if _, err := io.ReadFull(file, movable[:]); err != nil {
+		return movable, badRequest("reading movable", err)
+	}
+	return movable, nil
+}
+
+// readMsedData gets the optional msed_data out of an /upload form
+func readMsedData(r *http.Request) ([12]byte, error) {
+	var msed [12]byte
+	file, header, err := r.FormFile("msed")
+	if err != nil {
+		return msed, badRequest("upload without msed_data", err)
+	}
+	defer file.Close()
+	if header.Size != 12 {
+		return msed, badRequest("msed_data is the wrong size", nil)
+	}
+	if _, err := io.ReadFull(file, msed[:]); err != nil {
+		return msed, badRequest("reading msed_data", err)
+	}
+	return msed, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const uploadBoundary = "seedhelperfuzz"
+
+// uploadForm builds an /upload body with the given files, a nil file is left out
+func uploadForm(movable []byte, msed []byte) []byte {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.SetBoundary(uploadBoundary)
+	if movable != nil {
+		part, _ := form.CreateFormFile("movable", "movable.sed")
+		part.Write(movable)
+	}
+	if msed != nil {
+		part, _ := form.CreateFormFile("msed", "msed_data.bin")
+		part.Write(msed)
+	}
+	form.Close()
+	return body.Bytes()
+}
+
+func FuzzUpload(f *testing.F) {
+	f.Add(uploadForm(make([]byte, 0x120), make([]byte, 12)))
+	f.Add(uploadForm(make([]byte, 0x140), nil))
+	// used to dereference a missing msed_data header
+	f.Add(uploadForm(make([]byte, 0x120), []byte{}))
+	f.Add(uploadForm(make([]byte, 0x11F), make([]byte, 13)))
+	f.Add(uploadForm(nil, nil))
+	f.Add([]byte("--" + uploadBoundary + "\r\nContent-Disposition: form-data; name=\"movable\"; filename=\"m\"\r\n\r\n"))
+
+	const id0 = "0123456789abcdef0123456789abcdef"
+	router := mux.NewRouter()
+	router.HandleFunc("/upload/{id0}", serveUpload).Methods("POST")
+	if useTestStore() {
+		// something for valid uploads to complete
+		devices.Insert(bson.M{"_id": id0, "haspart1": true, "wantsbf": true})
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		r := httptest.NewRequest("POST", "/upload/"+id0, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary="+uploadBoundary)
+		_, err := readMovable(r)
+		valid := err == nil
+		if valid {
+			if file, header, _ := r.FormFile("movable"); header.Size != 0x120 && header.Size != 0x140 {
+				t.Fatalf("accepted a movable of %d bytes", header.Size)
+			} else {
+				file.Close()
+			}
+		}
+		if _, err := readMsedData(r); err == nil {
+			if _, header, _ := r.FormFile("msed"); header.Size != 12 {
+				t.Fatalf("accepted msed_data of %d bytes", header.Size)
+			}
+		}
+		if valid && useTestStore() == false {
+			return
+		}
+
+		resetLimits()
+		r = httptest.NewRequest("POST", "/upload/"+id0, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary="+uploadBoundary)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if valid == false && (w.Code != 400 || w.Body.String() == "success") {
+			t.Fatalf("invalid upload answered %d %q", w.Code, w.Body.String())
+		}
+		if valid && w.Body.String() != "success" {
+			t.Fatalf("valid upload answered %d %q", w.Code, w.Body.String())
+		}
+	})
+}